@@ -0,0 +1,237 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gookit/color"
+)
+
+// nodeTotals sums a node's channels for the combined channel list.
+type nodeTotals struct {
+	Name     string
+	PubKey   string
+	Alias    string
+	Chans    int
+	Capacity int64
+	Local    int64
+	Remote   int64
+	FwdRcv   uint64
+	FwdSnd   uint64
+}
+
+func (totals *nodeTotals) add(row *ChanRow) {
+	totals.Chans += 1
+	totals.Capacity += row.Chan.Capacity
+	totals.Local += row.Chan.LocalBalance
+	totals.Remote += row.Chan.RemoteBalance
+	totals.FwdRcv += row.FwdStats.AmountRcv
+	totals.FwdSnd += row.FwdStats.AmountSnd
+}
+
+// listChannelsAllNodes lists the channels of every node profile in one
+// table, sorted together, with each node's totals and the totals of
+// all of them.  Channels between our nodes are marked, they appear
+// once from each end.
+func listChannelsAllNodes(opts *ListChannelsCmd) error {
+	width := len("Node")
+	for _, name := range gCfg.nodeNames() {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	// The channel IDs are formatted while connected, chanpoint
+	// formatting needs the node.
+	rows := []*ChanRow{}
+	rowNode := map[*ChanRow]string{}
+	rowChanId := map[*ChanRow]string{}
+	nodes := []*nodeTotals{}
+	err := forEachNode(func(name string) error {
+		nodeRows, info, err := filteredChanRows(opts)
+		if err != nil {
+			return err
+		}
+		totals := &nodeTotals{
+			Name: name, PubKey: info.IdentityPubkey, Alias: info.Alias,
+		}
+		for _, row := range nodeRows {
+			rowNode[row] = name
+			rowChanId[row] = fmtChanId(row.Chan.ChanId)
+			totals.add(row)
+		}
+		rows = append(rows, nodeRows...)
+		nodes = append(nodes, totals)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ourNodes := map[string]bool{}
+	for _, totals := range nodes {
+		ourNodes[totals.PubKey] = true
+	}
+
+	sortChanRows(rows, opts.Sort, opts.Reverse)
+
+	idWidth := 19
+	for _, chanId := range rowChanId {
+		if len(chanId) > idWidth {
+			idWidth = len(chanId)
+		}
+	}
+	color.Bold.Printf("%-*s %*s Flg  Capacity     Local    Remote  Imbalance FwdR  FwdS  PubKey                                                             Alias\n",
+		width, "Node", idWidth, "ChanId")
+	internal := 0
+	for _, row := range rows {
+		chn := row.Chan
+
+		flags := "R"
+		if chn.Initiator {
+			flags = "L"
+		}
+		if chn.Active {
+			flags += "A"
+		} else {
+			flags += "I"
+		}
+		switch {
+		case row.Lookup.Err != nil:
+			flags += "?"
+		case row.Disabled():
+			flags += "D"
+		default:
+			flags += "E"
+		}
+
+		alias := row.Alias()
+		if row.Lookup.Err != nil {
+			alias = row.Lookup.Err.Error()
+		}
+		if ourNodes[chn.RemotePubkey] {
+			alias += " (ours)"
+			internal += 1
+		}
+
+		str := fmt.Sprintf("%-*s %*s %s %9d %9d %9d %10d %s %s %s %s",
+			width, rowNode[row],
+			idWidth, rowChanId[row],
+			flags,
+			chn.Capacity,
+			chn.LocalBalance,
+			chn.RemoteBalance,
+			row.Imbalance,
+			fmtAmountSci(float64(row.FwdStats.AmountRcv)),
+			fmtAmountSci(float64(row.FwdStats.AmountSnd)),
+			abbrevPubKey(chn.RemotePubkey),
+			alias,
+		)
+		if row.Lookup.Err != nil || row.Disabled() {
+			color.Red.Println(str)
+		} else if !chn.Active {
+			color.Yellow.Println(str)
+		} else {
+			color.Black.Println(str)
+		}
+	}
+
+	fmt.Println()
+	all := &nodeTotals{Name: "all"}
+	printTotals := func(totals *nodeTotals) {
+		color.Bold.Printf("%-*s %-*d %9d %9d %9d %10d %s %s %s %s\n",
+			width, totals.Name,
+			idWidth+4, totals.Chans,
+			totals.Capacity,
+			totals.Local,
+			totals.Remote,
+			totals.Local-((totals.Local+totals.Remote)/2),
+			fmtAmountSci(float64(totals.FwdRcv)),
+			fmtAmountSci(float64(totals.FwdSnd)),
+			abbrevPubKey(totals.PubKey),
+			totals.Alias,
+		)
+	}
+	for _, totals := range nodes {
+		printTotals(totals)
+		all.Chans += totals.Chans
+		all.Capacity += totals.Capacity
+		all.Local += totals.Local
+		all.Remote += totals.Remote
+		all.FwdRcv += totals.FwdRcv
+		all.FwdSnd += totals.FwdSnd
+	}
+	printTotals(all)
+	if internal > 0 {
+		fmt.Printf("%d of the channels are between our nodes, counted from both ends\n",
+			internal)
+	}
+	return nil
+}
+
+// A nodeRecommendation is the loop recommend picks for a node.
+type nodeRecommendation struct {
+	Node   string
+	Rec    *Recommendation
+	SrcId  string
+	DstId  string
+	Amount int64
+}
+
+// recommendAllNodes ranks the loop recommend picks on each node by
+// amount, printing them or, with doit, rebalancing the largest.
+func recommendAllNodes(doit bool) error {
+	picks := []*nodeRecommendation{}
+	err := forEachNode(func(name string) error {
+		maybeTakeSample()
+		recs, err := recommendations(recommendChannels())
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if rec.RecentlyFailed {
+				continue
+			}
+			picks = append(picks, &nodeRecommendation{
+				Node:   name,
+				Rec:    rec,
+				SrcId:  fmtChanId(rec.Loop.SrcChan),
+				DstId:  fmtChanId(rec.Loop.DstChan),
+				Amount: rec.Amount,
+			})
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(picks) == 0 {
+		fmt.Println("no loops recommended")
+		return nil
+	}
+	sort.SliceStable(picks, func(ii, jj int) bool {
+		return picks[ii].Amount > picks[jj].Amount
+	})
+
+	if doit {
+		pick := picks[0]
+		return withNode(pick.Node, func() error {
+			color.Bold.Printf("[%s] %s\n", pick.Node, gNode)
+			doRebalance(pick.Amount, pick.Rec.Loop.SrcChan, pick.Rec.Loop.DstChan,
+				pick.Rec.FeeLimitRate)
+			return nil
+		})
+	}
+
+	for _, pick := range picks {
+		fmt.Printf("lndtool --node %s rebalance -a %d -s %s -d %s  # fee limit %.0f ppm, %d sat\n",
+			pick.Node, pick.Amount, pick.SrcId, pick.DstId,
+			pick.Rec.FeeLimitRate*1e6,
+			int64(float64(pick.Amount)*pick.Rec.FeeLimitRate))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// gOurNodes holds the identity pubkeys of the nodes we operate when
+// rebalancing between them.  Fees they charge are internal, they come
+// back to us, so they don't count against the fee limit.
+var gOurNodes = map[string]bool{}
+
+func internalFeesMsat(route *lnrpc.Route) int64 {
+	sum := int64(0)
+	for _, hop := range route.Hops {
+		if gOurNodes[hop.PubKey] {
+			sum += hop.FeeMsat
+		}
+	}
+	return sum
+}
+
+// rebalanceBetween rebalances the from node with a loop which leaves
+// through its channel to the to node, so the first forwarding hop is
+// our own.  Unless given, the destination is the from node's channel
+// most short of local balance.
+func rebalanceBetween(from, to string, amt int64, dstArg chanArg) error {
+	if from == to {
+		return fmt.Errorf("--from and --to must be different nodes")
+	}
+	baseCfg := gCfg
+	defer func() { gCfg = baseCfg }()
+
+	if err := connectNode(to); err != nil {
+		return err
+	}
+	toPubKey := gNode
+
+	gCfg = baseCfg
+	if err := connectNode(from); err != nil {
+		return err
+	}
+	fromPubKey := gNode
+
+	dstChanId, err := dstArg.resolveBest(mostRemote)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
+		ActiveOnly: true,
+	})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+
+	var srcChan, dstChan *lnrpc.Channel
+	for _, chn := range rsp.Channels {
+		if chn.RemotePubkey == toPubKey {
+			if srcChan == nil || chn.LocalBalance > srcChan.LocalBalance {
+				srcChan = chn
+			}
+			continue
+		}
+		if dstChanId != 0 {
+			if chn.ChanId == dstChanId {
+				dstChan = chn
+			}
+		} else if dstChan == nil ||
+			chn.LocalBalance-chn.Capacity/2 < dstChan.LocalBalance-dstChan.Capacity/2 {
+			dstChan = chn
+		}
+	}
+	if srcChan == nil {
+		return fmt.Errorf("%s has no active channel to %s", from, to)
+	}
+	if dstChan == nil {
+		if dstChanId != 0 {
+			return fmt.Errorf("%s is not an active channel of %s or goes to %s",
+				fmtChanId(dstChanId), from, to)
+		}
+		return fmt.Errorf("%s has no other active channels", from)
+	}
+
+	if amt == 0 {
+		amt = gCfg.Recommend.TransferAmount
+	}
+
+	gOurNodes = map[string]bool{fromPubKey: true, toPubKey: true}
+	defer func() { gOurNodes = map[string]bool{} }()
+
+	// A successful loop prints its own internal and external fees.
+	doRebalance(amt, srcChan.ChanId, dstChan.ChanId,
+		chanFeeLimitRate(amt, dstChan.ChanId))
+
+	tally := loopFeeTally(toPubKey)
+	color.Bold.Printf("%s -> %s all runs: %d loops, %d sat moved, fees %d msat internal, %d msat external\n",
+		from, to,
+		tally.Loops,
+		tally.Amount,
+		tally.InternalFeeMsat,
+		tally.FeeMsat-tally.InternalFeeMsat,
+	)
+	return nil
+}
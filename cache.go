@@ -0,0 +1,157 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// The node and channel info caches sit in front of GetNodeInfo and
+// GetChanInfo.  Entries are kept in memory for the life of the process
+// and, if cache.persist is set, in the database between runs.
+
+type NodeInfoEntry struct {
+	Tstamp        int64
+	Alias         string
+	TotalCapacity int64
+	NumChannels   uint32
+}
+
+type ChanInfoEntry struct {
+	Tstamp int64
+	Edge   *lnrpc.ChannelEdge
+}
+
+type CacheStats struct {
+	NodeHits   int
+	NodeMisses int
+	ChanHits   int
+	ChanMisses int
+}
+
+var (
+	gCacheMtx   sync.Mutex
+	gNodeCache  = map[string]*NodeInfoEntry{}
+	gChanCache  = map[uint64]*ChanInfoEntry{}
+	gCacheStats CacheStats
+)
+
+func cacheFresh(tstamp int64) bool {
+	return time.Now().Unix()-tstamp < int64(gCfg.Cache.TTL.Seconds())
+}
+
+// getNodeInfo returns the alias and capacity of a node, using the
+// cache when the entry is fresh.
+func getNodeInfo(pubkey string) (*NodeInfoEntry, error) {
+	gCacheMtx.Lock()
+	entry, ok := gNodeCache[pubkey]
+	if ok && cacheFresh(entry.Tstamp) {
+		gCacheStats.NodeHits += 1
+		gCacheMtx.Unlock()
+		return entry, nil
+	}
+	gCacheMtx.Unlock()
+
+	if gCfg.Cache.Persist {
+		entry = selectNodeInfoCache(pubkey)
+		if entry != nil && cacheFresh(entry.Tstamp) {
+			gCacheMtx.Lock()
+			gCacheStats.NodeHits += 1
+			gNodeCache[pubkey] = entry
+			gCacheMtx.Unlock()
+			return entry, nil
+		}
+	}
+
+	nodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
+		PubKey: pubkey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry = &NodeInfoEntry{
+		Tstamp:        time.Now().Unix(),
+		Alias:         nodeInfo.Node.Alias,
+		TotalCapacity: nodeInfo.TotalCapacity,
+		NumChannels:   nodeInfo.NumChannels,
+	}
+
+	gCacheMtx.Lock()
+	gCacheStats.NodeMisses += 1
+	gNodeCache[pubkey] = entry
+	gCacheMtx.Unlock()
+
+	if gCfg.Cache.Persist {
+		upsertNodeInfoCache(pubkey, entry)
+	}
+	return entry, nil
+}
+
+// getChanInfo returns the channel edge (including both policies),
+// using the cache when the entry is fresh.
+func getChanInfo(chanId uint64) (*lnrpc.ChannelEdge, error) {
+	gCacheMtx.Lock()
+	entry, ok := gChanCache[chanId]
+	if ok && cacheFresh(entry.Tstamp) {
+		gCacheStats.ChanHits += 1
+		gCacheMtx.Unlock()
+		return entry.Edge, nil
+	}
+	gCacheMtx.Unlock()
+
+	if gCfg.Cache.Persist {
+		entry = selectChanInfoCache(chanId)
+		if entry != nil && cacheFresh(entry.Tstamp) {
+			gCacheMtx.Lock()
+			gCacheStats.ChanHits += 1
+			gChanCache[chanId] = entry
+			gCacheMtx.Unlock()
+			return entry.Edge, nil
+		}
+	}
+
+	edge, err := gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{
+		ChanId: chanId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry = &ChanInfoEntry{
+		Tstamp: time.Now().Unix(),
+		Edge:   edge,
+	}
+
+	gCacheMtx.Lock()
+	gCacheStats.ChanMisses += 1
+	gChanCache[chanId] = entry
+	gCacheMtx.Unlock()
+
+	if gCfg.Cache.Persist {
+		upsertChanInfoCache(chanId, entry)
+	}
+	return edge, nil
+}
+
+// invalidateChanInfo drops a channel from the cache, used when a
+// routing failure suggests its policy has changed.
+func invalidateChanInfo(chanId uint64) {
+	gCacheMtx.Lock()
+	delete(gChanCache, chanId)
+	gCacheMtx.Unlock()
+
+	if gCfg.Cache.Persist {
+		deleteChanInfoCache(chanId)
+	}
+}
+
+func dumpCacheStats() {
+	gCacheMtx.Lock()
+	defer gCacheMtx.Unlock()
+	fmt.Printf("cache: node %d hits %d misses, chan %d hits %d misses\n",
+		gCacheStats.NodeHits, gCacheStats.NodeMisses,
+		gCacheStats.ChanHits, gCacheStats.ChanMisses)
+}
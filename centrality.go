@@ -0,0 +1,147 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// centralitySources picks the nodes used as sources for the
+// betweenness estimate.  A fixed seed keeps the choice stable so that
+// estimates made before and after changing the graph are comparable.
+func (graph *Graph) centralitySources(samples int) []*Node {
+	all := graph.sortedNodes()
+	if samples <= 0 || samples >= len(all) {
+		return all
+	}
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Shuffle(len(all), func(ii, jj int) { all[ii], all[jj] = all[jj], all[ii] })
+	return all[:samples]
+}
+
+func (graph *Graph) sortedNodes() []*Node {
+	all := []*Node{}
+	for _, nn := range graph.Nodes {
+		all = append(all, nn)
+	}
+	sort.Slice(all, func(ii, jj int) bool {
+		return all[ii].PubKey < all[jj].PubKey
+	})
+	return all
+}
+
+// Betweenness estimates the betweenness centrality of every node by
+// running Brandes' algorithm (hop count shortest paths over enabled
+// edges) from a sample of source nodes and scaling the result up to
+// the full graph.
+func (graph *Graph) Betweenness(samples int) map[*Node]float64 {
+	sources := graph.centralitySources(samples)
+	scale := float64(len(graph.Nodes)) / float64(len(sources))
+
+	// Index the nodes so the per-source state can live in slices.
+	all := graph.sortedNodes()
+	index := make(map[*Node]int, len(all))
+	for ndx, nn := range all {
+		index[nn] = ndx
+	}
+
+	centrality := make([]float64, len(all))
+	sigma := make([]float64, len(all))
+	dist := make([]int, len(all))
+	delta := make([]float64, len(all))
+	preds := make([][]int, len(all))
+
+	for _, src := range sources {
+		for ii := range all {
+			sigma[ii] = 0
+			dist[ii] = -1
+			delta[ii] = 0
+			preds[ii] = preds[ii][:0]
+		}
+		ss := index[src]
+		sigma[ss] = 1
+		dist[ss] = 0
+
+		// Breadth first search recording the visit order.
+		order := []int{}
+		queue := []int{ss}
+		for len(queue) > 0 {
+			vv := queue[0]
+			queue = queue[1:]
+			order = append(order, vv)
+			for _, peer := range all[vv].Peers {
+				ww := index[peer]
+				if dist[ww] < 0 {
+					dist[ww] = dist[vv] + 1
+					queue = append(queue, ww)
+				}
+				if dist[ww] == dist[vv]+1 {
+					sigma[ww] += sigma[vv]
+					preds[ww] = append(preds[ww], vv)
+				}
+			}
+		}
+
+		// Accumulate dependencies in reverse order.
+		for ii := len(order) - 1; ii >= 0; ii-- {
+			ww := order[ii]
+			for _, vv := range preds[ww] {
+				delta[vv] += (sigma[vv] / sigma[ww]) * (1 + delta[ww])
+			}
+			if ww != ss {
+				centrality[ww] += delta[ww]
+			}
+		}
+	}
+
+	retval := make(map[*Node]float64, len(all))
+	for ndx, nn := range all {
+		retval[nn] = centrality[ndx] * scale
+	}
+	return retval
+}
+
+// rankOf returns the 1-based rank of node when the nodes are ordered
+// by value descending.
+func rankOf(values map[*Node]float64, node *Node) int {
+	rank := 1
+	for nn, vv := range values {
+		if nn != node && vv > values[node] {
+			rank += 1
+		}
+	}
+	return rank
+}
+
+// percentiles maps each node to the fraction of nodes with a smaller
+// value, so every factor lands in [0, 1] regardless of its units.
+func percentiles(values map[*Node]float64) map[*Node]float64 {
+	all := []*Node{}
+	for nn := range values {
+		all = append(all, nn)
+	}
+	sort.Slice(all, func(ii, jj int) bool {
+		return values[all[ii]] < values[all[jj]]
+	})
+
+	retval := make(map[*Node]float64, len(all))
+	if len(all) < 2 {
+		for _, nn := range all {
+			retval[nn] = 1
+		}
+		return retval
+	}
+	for ndx := 0; ndx < len(all); {
+		// Ties share the rank of the first of them.
+		end := ndx
+		for end < len(all) && values[all[end]] == values[all[ndx]] {
+			end += 1
+		}
+		for _, nn := range all[ndx:end] {
+			retval[nn] = float64(ndx) / float64(len(all)-1)
+		}
+		ndx = end
+	}
+	return retval
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Channels are identified by lnd's uint64 channel ID, by the short
+// channel ID BLOCKxTXxOUT packed into it, or by the funding channel
+// point txid:vout.
+
+func shortChanId(chanId uint64) string {
+	return fmt.Sprintf("%dx%dx%d",
+		chanId>>40, (chanId>>16)&0xffffff, chanId&0xffff)
+}
+
+func parseShortChanId(str string) (uint64, error) {
+	parts := strings.Split(str, "x")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("expected BLOCKxTXxOUT")
+	}
+	block, err1 := strconv.ParseUint(parts[0], 10, 24)
+	tx, err2 := strconv.ParseUint(parts[1], 10, 24)
+	out, err3 := strconv.ParseUint(parts[2], 10, 16)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("expected BLOCKxTXxOUT")
+	}
+	return block<<40 | tx<<16 | out, nil
+}
+
+// chanPoints maps the IDs of our open and closed channels to their
+// channel points, loaded when first needed.
+var chanPoints map[uint64]string
+
+func loadChanPoints() map[uint64]string {
+	if chanPoints != nil {
+		return chanPoints
+	}
+	chanPoints = map[uint64]string{}
+
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+	for _, chn := range rsp.Channels {
+		chanPoints[chn.ChanId] = chn.ChannelPoint
+	}
+
+	closed, err := gClient.ClosedChannels(gCtx, &lnrpc.ClosedChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ClosedChannels failed:", err))
+	}
+	for _, chn := range closed.Channels {
+		if chn.ChanId != 0 {
+			chanPoints[chn.ChanId] = chn.ChannelPoint
+		}
+	}
+	return chanPoints
+}
+
+// chanIdWidth returns the width of a column of channel IDs formatted
+// with fmtChanId.
+func chanIdWidth() int {
+	width := 19
+	if gCfg.ChanIdFormat == "chanpoint" {
+		for _, point := range loadChanPoints() {
+			if len(point) > width {
+				width = len(point)
+			}
+		}
+	}
+	return width
+}
+
+// fmtChanId formats the channel ID as chosen with --chanid-format.
+// Channels whose channel point isn't known are shown as short channel
+// IDs.
+func fmtChanId(chanId uint64) string {
+	switch gCfg.ChanIdFormat {
+	case "scid":
+		return shortChanId(chanId)
+	case "chanpoint":
+		if point, ok := loadChanPoints()[chanId]; ok {
+			return point
+		}
+		return shortChanId(chanId)
+	default:
+		return strconv.FormatUint(chanId, 10)
+	}
+}
+
+// A chanArg is a channel given on the command line or in the config
+// file in any of the formats, or a peer as resolvePeer accepts.
+// Channel points and peers are looked up when the channel ID is
+// needed, once connected.
+type chanArg struct {
+	chanId uint64
+	point  string
+	peer   string
+}
+
+func (arg *chanArg) UnmarshalFlag(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("expected a channel or a peer")
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 && len(parts[0]) == 64 {
+		if _, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+			*arg = chanArg{point: value}
+			return nil
+		}
+	}
+	if chanId, err := parseShortChanId(value); err == nil {
+		*arg = chanArg{chanId: chanId}
+		return nil
+	}
+	// Pubkeys start with 02 or 03, channel IDs never start with 0.
+	if !strings.HasPrefix(value, "0") {
+		if chanId, err := strconv.ParseUint(value, 10, 64); err == nil {
+			*arg = chanArg{chanId: chanId}
+			return nil
+		}
+	}
+	*arg = chanArg{peer: value}
+	return nil
+}
+
+func (arg chanArg) MarshalFlag() (string, error) {
+	return arg.String(), nil
+}
+
+func (arg chanArg) MarshalText() ([]byte, error) {
+	return []byte(arg.String()), nil
+}
+
+// String returns the channel as it was given, short channel IDs as
+// uint64 IDs.
+func (arg chanArg) String() string {
+	if arg.peer != "" {
+		return arg.peer
+	}
+	if arg.point != "" {
+		return arg.point
+	}
+	return strconv.FormatUint(arg.chanId, 10)
+}
+
+// resolve returns the channel ID, looking up channel points among our
+// open and closed channels.  A peer must have just one channel with us.
+func (arg chanArg) resolve() (uint64, error) {
+	if arg.peer != "" {
+		peerChans, err := arg.peerChannels()
+		if err != nil {
+			return 0, err
+		}
+		if len(peerChans) > 1 {
+			strs := []string{}
+			for _, chn := range peerChans {
+				strs = append(strs, fmtChanId(chn.ChanId))
+			}
+			return 0, fmt.Errorf("we have %d channels with %s, give one of %s",
+				len(peerChans), arg.peer, strings.Join(strs, ", "))
+		}
+		return peerChans[0].ChanId, nil
+	}
+	if arg.point == "" {
+		return arg.chanId, nil
+	}
+	for chanId, point := range loadChanPoints() {
+		if point == arg.point {
+			return chanId, nil
+		}
+	}
+	return 0, fmt.Errorf("channel point %s is not one of our channels", arg.point)
+}
+
+// chanIdSet returns the IDs of the channels, all of a peer's channels
+// for a peer.  Any argument which doesn't resolve is an error, leaving
+// it out could empty the set, which means all channels to its users.
+func chanIdSet(args []chanArg) (map[uint64]bool, error) {
+	set := map[uint64]bool{}
+	for _, arg := range args {
+		if arg.peer != "" {
+			peerChans, err := arg.peerChannels()
+			if err != nil {
+				return nil, err
+			}
+			for _, chn := range peerChans {
+				set[chn.ChanId] = true
+			}
+			continue
+		}
+		chanId, err := arg.resolve()
+		if err != nil {
+			return nil, err
+		}
+		set[chanId] = true
+	}
+	return set, nil
+}
@@ -5,7 +5,10 @@ package main
 import (
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	// "github.com/davecgh/go-spew/spew"
@@ -26,20 +29,16 @@ type FwdStatsElem struct {
 type FwdStats map[uint64]*FwdStatsElem
 
 func getFwdStats() *FwdStats {
-	retval := FwdStats{}
+	now := time.Now()
+	return getFwdStatsRange(now.Add(-gCfg.Channels.StatsWindow), now)
+}
 
-	// TODO - need a loop reading batches here
+const fwdHistoryBatch = 1000
 
-	hist, err := gClient.ForwardingHistory(gCtx, &lnrpc.ForwardingHistoryRequest{
-		StartTime:    uint64((time.Now().Add(-gCfg.Channels.StatsWindow)).Unix()),
-		EndTime:      uint64(time.Now().Unix()),
-		NumMaxEvents: uint32(1000),
-	})
-	if err != nil {
-		panic(fmt.Sprint("ForwardingHistory failed: %v\n", err))
-	}
+func getFwdStatsRange(start, end time.Time) *FwdStats {
+	retval := FwdStats{}
 
-	for _, evt := range hist.ForwardingEvents {
+	for _, evt := range getFwdEvents(start, end) {
 		rcvElem, ok := retval[evt.ChanIdIn]
 		if !ok {
 			rcvElem = &FwdStatsElem{}
@@ -63,6 +62,30 @@ func getFwdStats() *FwdStats {
 	return &retval
 }
 
+// getFwdEvents reads the forwarding history in batches.
+func getFwdEvents(start, end time.Time) []*lnrpc.ForwardingEvent {
+	events := []*lnrpc.ForwardingEvent{}
+	offset := uint32(0)
+	for {
+		hist, err := gClient.ForwardingHistory(gCtx,
+			&lnrpc.ForwardingHistoryRequest{
+				StartTime:    uint64(start.Unix()),
+				EndTime:      uint64(end.Unix()),
+				IndexOffset:  offset,
+				NumMaxEvents: uint32(fwdHistoryBatch),
+			})
+		if err != nil {
+			panic(fmt.Sprint("ForwardingHistory failed: %v\n", err))
+		}
+		events = append(events, hist.ForwardingEvents...)
+		if len(hist.ForwardingEvents) < fwdHistoryBatch {
+			break
+		}
+		offset = hist.LastOffsetIndex
+	}
+	return events
+}
+
 func abbrevPubKey(pubkey string) string {
 	// ll := len(pubkey)
 	// return pubkey[0:4] + ".." + pubkey[ll-4:ll]
@@ -81,7 +104,178 @@ func fmtAmountSci(amt float64) string {
 	}
 }
 
-func listChannels() {
+type ChanLookup struct {
+	NodeInfo *NodeInfoEntry
+	Policy   *lnrpc.RoutingPolicy // our policy for the channel
+	Err      error
+}
+
+func lookupChannel(chn *lnrpc.Channel) *ChanLookup {
+	nodeInfo, err := getNodeInfo(chn.RemotePubkey)
+	if err != nil {
+		return &ChanLookup{Err: fmt.Errorf("GetNodeInfo failed: %v", err)}
+	}
+
+	chanInfo, err := getChanInfo(chn.ChanId)
+	if err != nil {
+		return &ChanLookup{Err: fmt.Errorf("GetChanInfo failed: %v", err)}
+	}
+	var policy *lnrpc.RoutingPolicy
+	if chanInfo.Node1Pub == chn.RemotePubkey {
+		policy = chanInfo.Node2Policy
+	} else {
+		policy = chanInfo.Node1Policy
+	}
+	if policy == nil {
+		return &ChanLookup{Err: fmt.Errorf("no routing policy")}
+	}
+
+	return &ChanLookup{NodeInfo: nodeInfo, Policy: policy}
+}
+
+// lookupChannels fetches node and channel info for each channel using
+// a bounded pool of workers.  The results are in the same order as
+// the channels.
+func lookupChannels(chans []*lnrpc.Channel) []*ChanLookup {
+	results := make([]*ChanLookup, len(chans))
+
+	workers := gCfg.Channels.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	ndxs := make(chan int)
+	var wg sync.WaitGroup
+	for ii := 0; ii < workers; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ndx := range ndxs {
+				results[ndx] = lookupChannel(chans[ndx])
+			}
+		}()
+	}
+	for ndx := range chans {
+		ndxs <- ndx
+	}
+	close(ndxs)
+	wg.Wait()
+
+	return results
+}
+
+type ChanRow struct {
+	Chan      *lnrpc.Channel
+	Lookup    *ChanLookup
+	FwdStats  *FwdStatsElem
+	Imbalance int64
+	Age       uint32 // blocks since the funding transaction confirmed
+}
+
+func (row *ChanRow) Alias() string {
+	if row.Lookup == nil || row.Lookup.NodeInfo == nil {
+		return ""
+	}
+	return row.Lookup.NodeInfo.Alias
+}
+
+func (row *ChanRow) Disabled() bool {
+	return row.Lookup != nil && row.Lookup.Policy != nil &&
+		row.Lookup.Policy.Disabled
+}
+
+// chanHeight returns the block height encoded in a channel id.
+func chanHeight(chanId uint64) uint32 {
+	return uint32(chanId >> 40)
+}
+
+// peerMatcher returns a function which matches a channel's peer by
+// pubkey prefix or alias regular expression.
+func peerMatcher(peer string) (func(pubkey, alias string) bool, error) {
+	re, err := regexp.Compile(peer)
+	if err != nil {
+		return nil, fmt.Errorf("bad --peer expression: %v", err)
+	}
+	lower := strings.ToLower(peer)
+	return func(pubkey, alias string) bool {
+		return strings.HasPrefix(pubkey, lower) || re.MatchString(alias)
+	}, nil
+}
+
+// chanRows looks up the node and channel info of the channels and
+// returns their rows in the same order.
+func chanRows(chans []*lnrpc.Channel, fwdStats *FwdStats, height uint32) []*ChanRow {
+	lookups := lookupChannels(chans)
+
+	rows := []*ChanRow{}
+	for ndx, chn := range chans {
+		row := &ChanRow{
+			Chan:     chn,
+			Lookup:   lookups[ndx],
+			FwdStats: (*fwdStats)[chn.ChanId],
+			Imbalance: chn.LocalBalance -
+				((chn.LocalBalance + chn.RemoteBalance) / 2),
+			Age: height - chanHeight(chn.ChanId),
+		}
+		if row.FwdStats == nil {
+			row.FwdStats = &FwdStatsElem{}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// chanSortKeys are the columns sortChanRows sorts by.
+var chanSortKeys = []string{
+	"chanid", "imbalance", "capacity", "local",
+	"fwd-in", "fwd-out", "fees", "alias", "age",
+}
+
+func sortChanRows(rows []*ChanRow, key string, reverse bool) {
+	less := func(ii, jj *ChanRow) bool {
+		switch key {
+		case "imbalance":
+			return ii.Imbalance < jj.Imbalance
+		case "capacity":
+			return ii.Chan.Capacity < jj.Chan.Capacity
+		case "local":
+			return ii.Chan.LocalBalance < jj.Chan.LocalBalance
+		case "fwd-in":
+			return ii.FwdStats.AmountRcv < jj.FwdStats.AmountRcv
+		case "fwd-out":
+			return ii.FwdStats.AmountSnd < jj.FwdStats.AmountSnd
+		case "fees":
+			return ii.FwdStats.FeeMsatSnd < jj.FwdStats.FeeMsatSnd
+		case "alias":
+			return strings.ToLower(ii.Alias()) < strings.ToLower(jj.Alias())
+		case "age":
+			return ii.Age < jj.Age
+		default:
+			return ii.Chan.ChanId < jj.Chan.ChanId
+		}
+	}
+	sort.SliceStable(rows, func(ii, jj int) bool {
+		if reverse {
+			return less(rows[jj], rows[ii])
+		}
+		return less(rows[ii], rows[jj])
+	})
+}
+
+// filteredChanRows returns the rows of the channels which pass the
+// channels command's filters, unsorted.
+func filteredChanRows(opts *ListChannelsCmd) ([]*ChanRow, *lnrpc.GetInfoResponse, error) {
+
+	var matchPeer func(pubkey, alias string) bool
+	if opts.Peer != "" {
+		var err error
+		matchPeer, err = peerMatcher(opts.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	maybeTakeSample()
 
 	fwdStats := getFwdStats()
 
@@ -91,53 +285,63 @@ func listChannels() {
 	}
 
 	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
-		ActiveOnly:   false,
-		InactiveOnly: false,
+		ActiveOnly:   opts.Active,
+		InactiveOnly: opts.Inactive,
 		PublicOnly:   false,
-		PrivateOnly:  false,
+		PrivateOnly:  opts.Private,
 	})
 	if err != nil {
 		panic(fmt.Sprint("ListChannels failed:", err))
 	}
 
-	color.Bold.Println("             ChanId Flg  Capacity     Local    Remote  Imbalance FwdR  FwdS  PubKey                                                              Log Alias")
+	// Apply the filters which don't need the node and channel info
+	// before looking it up.
+	chans := []*lnrpc.Channel{}
+	for _, chn := range rsp.Channels {
+		if chn.Capacity < opts.MinCapacity {
+			continue
+		}
+		imbalance := chn.LocalBalance -
+			((chn.LocalBalance + chn.RemoteBalance) / 2)
+		if opts.ImbalancedAbove > 0 &&
+			imbalance < opts.ImbalancedAbove &&
+			imbalance > -opts.ImbalancedAbove {
+			continue
+		}
+		chans = append(chans, chn)
+	}
+
+	rows := []*ChanRow{}
+	for _, row := range chanRows(chans, fwdStats, info.BlockHeight) {
+		if opts.Disabled && !row.Disabled() {
+			continue
+		}
+		if matchPeer != nil && !matchPeer(row.Chan.RemotePubkey, row.Alias()) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, info, nil
+}
+
+func listChannels(opts *ListChannelsCmd) error {
+	rows, info, err := filteredChanRows(opts)
+	if err != nil {
+		return err
+	}
+	sortChanRows(rows, opts.Sort, opts.Reverse)
+
+	idWidth := chanIdWidth()
+	color.Bold.Printf("%*s Flg  Capacity     Local    Remote  Imbalance FwdR  FwdS  PubKey                                                              Log Alias\n", idWidth, "ChanId")
 
 	sumCapacity := int64(0)
 	sumLocal := int64(0)
 	sumRemote := int64(0)
 	sumFwdRcv := uint64(0)
 	sumFwdSnd := uint64(0)
-	sort.SliceStable(rsp.Channels, func(ii, jj int) bool {
-		return rsp.Channels[ii].ChanId < rsp.Channels[jj].ChanId
-	})
-	for _, chn := range rsp.Channels {
-		nodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
-			PubKey: chn.RemotePubkey,
-		})
-		if err != nil {
-			panic(fmt.Sprint("GetNodeInfo failed:", err))
-		}
-		rmtCap := nodeInfo.TotalCapacity
-		alias := nodeInfo.Node.Alias
-
-		chanInfo, err := gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{
-			ChanId: chn.ChanId,
-		})
-		if err != nil {
-			panic(fmt.Sprint("GetChanInfo failed:", err))
-		}
-		var policy *lnrpc.RoutingPolicy
-		if chanInfo.Node1Pub == chn.RemotePubkey {
-			policy = chanInfo.Node2Policy
-		} else {
-			policy = chanInfo.Node1Policy
-		}
-		var disabled string
-		if policy.Disabled {
-			disabled = "D"
-		} else {
-			disabled = "E"
-		}
+	for _, row := range rows {
+		chn := row.Chan
+		lookup := row.Lookup
 
 		var initiator string
 		if chn.Initiator {
@@ -153,8 +357,34 @@ func listChannels() {
 			active = "I"
 		}
 
-		imbalance := chn.LocalBalance -
-			((chn.LocalBalance + chn.RemoteBalance) / 2)
+		imbalance := row.Imbalance
+
+		sumCapacity += chn.Capacity
+		sumLocal += chn.LocalBalance
+		sumRemote += chn.RemoteBalance
+
+		if lookup.Err != nil {
+			// Report the failure on this row and carry on.
+			color.Red.Printf("%*s %s%s? %9d %9d %9d %10d %s %s\n",
+				idWidth, fmtChanId(chn.ChanId),
+				initiator,
+				active,
+				chn.Capacity,
+				chn.LocalBalance,
+				chn.RemoteBalance,
+				imbalance,
+				abbrevPubKey(chn.RemotePubkey),
+				lookup.Err,
+			)
+			continue
+		}
+
+		var disabled string
+		if lookup.Policy.Disabled {
+			disabled = "D"
+		} else {
+			disabled = "E"
+		}
 
 		chanStats := chanStats(chn.ChanId)
 		chnStatsStr := fmt.Sprintf("%1.0f %1.0f %1.0f %1.0f %1.0f %1.0f",
@@ -167,10 +397,7 @@ func listChannels() {
 		)
 		_ = chnStatsStr
 
-		chnFwdStats := (*fwdStats)[chn.ChanId]
-		if chnFwdStats == nil {
-			chnFwdStats = &FwdStatsElem{}
-		}
+		chnFwdStats := row.FwdStats
 		chnFwdStatsStr := fmt.Sprintf("%s %s",
 			fmtAmountSci(float64(chnFwdStats.AmountRcv)),
 			fmtAmountSci(float64(chnFwdStats.AmountSnd)),
@@ -178,8 +405,8 @@ func listChannels() {
 		sumFwdRcv += chnFwdStats.AmountRcv
 		sumFwdSnd += chnFwdStats.AmountSnd
 
-		str := fmt.Sprintf("%19d %s%s%s %9d %9d %9d %10d %s %s %4.1f %s",
-			chn.ChanId,
+		str := fmt.Sprintf("%*s %s%s%s %9d %9d %9d %10d %s %s %4.1f %s",
+			idWidth, fmtChanId(chn.ChanId),
 			initiator,
 			active,
 			disabled,
@@ -190,41 +417,41 @@ func listChannels() {
 			// chnStatsStr,
 			chnFwdStatsStr,
 			abbrevPubKey(chn.RemotePubkey),
-			math.Log10(float64(rmtCap+1)),
-			alias,
+			math.Log10(float64(lookup.NodeInfo.TotalCapacity+1)),
+			lookup.NodeInfo.Alias,
 		)
 
-		if policy.Disabled {
+		if lookup.Policy.Disabled {
 			color.Red.Println(str)
 		} else if !chn.Active {
 			color.Yellow.Println(str)
 		} else {
 			color.Black.Println(str)
 		}
-
-		sumCapacity += chn.Capacity
-		sumLocal += chn.LocalBalance
-		sumRemote += chn.RemoteBalance
 	}
 
 	pendingChannels, err := gClient.PendingChannels(gCtx, &lnrpc.PendingChannelsRequest{})
 	if err != nil {
 		panic(fmt.Sprint("PendingChannels failed:", err))
 	}
-	for _, chn2 := range pendingChannels.PendingOpenChannels {
+	// Pending channels don't have the state the filters look at, only
+	// show them in the unfiltered list.
+	pendingOpen := pendingChannels.PendingOpenChannels
+	if opts.Filtered() {
+		pendingOpen = nil
+	}
+	for _, chn2 := range pendingOpen {
 		disabled := "o"
 		initiator := "o"
 		active := "o"
 
 		rmtCap := int64(0)
 		alias := ""
-		nodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
-			PubKey: chn2.Channel.RemoteNodePub,
-		})
+		nodeInfo, err := getNodeInfo(chn2.Channel.RemoteNodePub)
 		if err == nil {
 			// Success path
 			rmtCap = nodeInfo.TotalCapacity
-			alias = nodeInfo.Node.Alias
+			alias = nodeInfo.Alias
 		}
 
 		chnFwdStatsStr := fmt.Sprintf("%s %s",
@@ -235,7 +462,8 @@ func listChannels() {
 		imbalance := chn2.Channel.LocalBalance -
 			((chn2.Channel.LocalBalance + chn2.Channel.RemoteBalance) / 2)
 
-		fmt.Printf("                    %s%s%s %9d %9d %9d %10d %s %s %4.1f %s\n",
+		fmt.Printf("%*s%s%s%s %9d %9d %9d %10d %s %s %4.1f %s\n",
+			idWidth+1, "",
 			initiator,
 			active,
 			disabled,
@@ -260,8 +488,8 @@ func listChannels() {
 
 	imbalance := sumLocal - ((sumLocal + sumRemote) / 2)
 
-	color.Bold.Printf("%-4d                    %9d %9d %9d %10d %s %s %4.1f %s\n",
-		len(rsp.Channels)+len(pendingChannels.PendingOpenChannels),
+	color.Bold.Printf("%-*d %9d %9d %9d %10d %s %s %4.1f %s\n",
+		idWidth+4, len(rows)+len(pendingOpen),
 		sumCapacity,
 		sumLocal,
 		sumRemote,
@@ -271,4 +499,74 @@ func listChannels() {
 		math.Log10(float64(sumCapacity+1)),
 		info.Alias,
 	)
+
+	if !opts.Filtered() {
+		printPendingCloses(pendingChannels)
+	}
+	return nil
+}
+
+func pendingAlias(pubkey string) string {
+	nodeInfo, err := getNodeInfo(pubkey)
+	if err != nil {
+		return ""
+	}
+	return nodeInfo.Alias
+}
+
+// printPendingCloses shows the channels which are on their way to
+// being closed.  Their balances are not included in the totals above.
+func printPendingCloses(pending *lnrpc.PendingChannelsResponse) {
+	if len(pending.PendingClosingChannels) > 0 {
+		fmt.Println()
+		color.Bold.Println("Closing                                                               Capacity     Local    Remote PubKey                                                             Alias")
+		for _, chn := range pending.PendingClosingChannels {
+			fmt.Printf("%-68s %9d %9d %9d %s %s\n",
+				chn.Channel.ChannelPoint,
+				chn.Channel.Capacity,
+				chn.Channel.LocalBalance,
+				chn.Channel.RemoteBalance,
+				abbrevPubKey(chn.Channel.RemoteNodePub),
+				pendingAlias(chn.Channel.RemoteNodePub),
+			)
+		}
+	}
+
+	if len(pending.WaitingCloseChannels) > 0 {
+		fmt.Println()
+		color.Bold.Println("Waiting Close                                                         Capacity     Local    Remote      Limbo PubKey                                                             Alias")
+		for _, chn := range pending.WaitingCloseChannels {
+			fmt.Printf("%-68s %9d %9d %9d %10d %s %s\n",
+				chn.Channel.ChannelPoint,
+				chn.Channel.Capacity,
+				chn.Channel.LocalBalance,
+				chn.Channel.RemoteBalance,
+				chn.LimboBalance,
+				abbrevPubKey(chn.Channel.RemoteNodePub),
+				pendingAlias(chn.Channel.RemoteNodePub),
+			)
+		}
+	}
+
+	if len(pending.PendingForceClosingChannels) > 0 {
+		fmt.Println()
+		color.Bold.Println("Force Closing                                                         Capacity      Limbo  Recovered Maturity Blocks HTLCs PubKey                                                             Alias")
+		for _, chn := range pending.PendingForceClosingChannels {
+			fmt.Printf("%-68s %9d %10d %10d %8d %6d %5d %s %s\n",
+				chn.Channel.ChannelPoint,
+				chn.Channel.Capacity,
+				chn.LimboBalance,
+				chn.RecoveredBalance,
+				chn.MaturityHeight,
+				chn.BlocksTilMaturity,
+				len(chn.PendingHtlcs),
+				abbrevPubKey(chn.Channel.RemoteNodePub),
+				pendingAlias(chn.Channel.RemoteNodePub),
+			)
+		}
+	}
+
+	if pending.TotalLimboBalance > 0 {
+		color.Bold.Printf("total limbo balance %d\n", pending.TotalLimboBalance)
+	}
 }
@@ -0,0 +1,108 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+var closeTypeNames = map[lnrpc.ChannelCloseSummary_ClosureType]string{
+	lnrpc.ChannelCloseSummary_COOPERATIVE_CLOSE:  "coop",
+	lnrpc.ChannelCloseSummary_LOCAL_FORCE_CLOSE:  "local-force",
+	lnrpc.ChannelCloseSummary_REMOTE_FORCE_CLOSE: "remote-force",
+	lnrpc.ChannelCloseSummary_BREACH_CLOSE:       "breach",
+	lnrpc.ChannelCloseSummary_FUNDING_CANCELED:   "canceled",
+	lnrpc.ChannelCloseSummary_ABANDONED:          "abandoned",
+}
+
+func closeTypeName(closeType lnrpc.ChannelCloseSummary_ClosureType) string {
+	name, ok := closeTypeNames[closeType]
+	if !ok {
+		return closeType.String()
+	}
+	return name
+}
+
+func listClosedChannels() {
+	rsp, err := gClient.ClosedChannels(gCtx, &lnrpc.ClosedChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ClosedChannels failed:", err))
+	}
+
+	// Lifetime forwarding stats, not just the stats window.
+	fwdStats := getFwdStatsRange(time.Unix(0, 0), time.Now())
+
+	sort.SliceStable(rsp.Channels, func(ii, jj int) bool {
+		return rsp.Channels[ii].CloseHeight < rsp.Channels[jj].CloseHeight
+	})
+
+	idWidth := chanIdWidth()
+	color.Bold.Printf("%*s Type          Blocks  Capacity   Settled FwdR  FwdS     Earned RebalFee       Net PubKey                                                             Alias\n",
+		idWidth, "ChanId")
+
+	sumCapacity := int64(0)
+	sumSettled := int64(0)
+	sumFwdRcv := uint64(0)
+	sumFwdSnd := uint64(0)
+	sumEarned := int64(0)
+	sumRebalFee := int64(0)
+	for _, chn := range rsp.Channels {
+		chnFwdStats := (*fwdStats)[chn.ChanId]
+		if chnFwdStats == nil {
+			chnFwdStats = &FwdStatsElem{}
+		}
+
+		// Fees are credited to the outgoing channel of a forward.
+		earned := int64(chnFwdStats.FeeMsatSnd / 1000)
+		rebalFee := rebalanceFeesMsat(chn.ChanId) / 1000
+
+		blocks := int64(0)
+		if chn.ChanId != 0 {
+			blocks = int64(chn.CloseHeight) - int64(chanHeight(chn.ChanId))
+		}
+
+		alias := ""
+		nodeInfo, err := getNodeInfo(chn.RemotePubkey)
+		if err == nil {
+			alias = nodeInfo.Alias
+		}
+
+		fmt.Printf("%*s %-12s %7d %9d %9d %s %s %9d %8d %9d %s %s\n",
+			idWidth, fmtChanId(chn.ChanId),
+			closeTypeName(chn.CloseType),
+			blocks,
+			chn.Capacity,
+			chn.SettledBalance,
+			fmtAmountSci(float64(chnFwdStats.AmountRcv)),
+			fmtAmountSci(float64(chnFwdStats.AmountSnd)),
+			earned,
+			rebalFee,
+			earned-rebalFee,
+			abbrevPubKey(chn.RemotePubkey),
+			alias,
+		)
+
+		sumCapacity += chn.Capacity
+		sumSettled += chn.SettledBalance
+		sumFwdRcv += chnFwdStats.AmountRcv
+		sumFwdSnd += chnFwdStats.AmountSnd
+		sumEarned += earned
+		sumRebalFee += rebalFee
+	}
+
+	color.Bold.Printf("%-*d %9d %9d %s %s %9d %8d %9d\n",
+		idWidth+21, len(rsp.Channels),
+		sumCapacity,
+		sumSettled,
+		fmtAmountSci(float64(sumFwdRcv)),
+		fmtAmountSci(float64(sumFwdSnd)),
+		sumEarned,
+		sumRebalFee,
+		sumEarned-sumRebalFee,
+	)
+}
@@ -4,29 +4,59 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/btcsuite/btcutil"
-	"github.com/davecgh/go-spew/spew"
 	// "github.com/davecgh/go-spew/spew"
 	flags "github.com/jessevdk/go-flags"
 )
 
 const (
 	defaultVerbose          = false
+	defaultChanIdFormat     = "uint64"
 	defaultNetwork          = "mainnet"
+	defaultChain            = "bitcoin"
 	defaultTLSCertFilename  = "tls.cert"
 	defaultMacaroonFilename = "admin.macaroon"
 	defaultRPCHost          = "localhost"
 
 	defaultStatsWindow = (time.Hour * 24 * 30)
+	defaultConcurrency = 8
 
-	defaultFinalCLTVDelta = uint32(144)
-	defaultFeeLimitRate   = float64(0.0005)
+	defaultCacheTTL     = (time.Minute * 10)
+	defaultCachePersist = false
+
+	defaultSampleInterval = (time.Minute * 10)
+
+	defaultCostModel   = "simple"
+	defaultRiskFactor  = 15.0
+	defaultAttemptCost = 100.0
+
+	defaultCentralitySamples = 100
+
+	defaultDistanceWeight   = 2.0
+	defaultCentralityWeight = 2.0
+	defaultChannelsWeight   = 1.0
+	defaultCapacityWeight   = 1.0
+	defaultFeesWeight       = 1.0
+	defaultAgeWeight        = 0.5
+	defaultReachWeight      = 1.0
+
+	defaultProbeMaxAge    = time.Hour
+	defaultProbePrecision = int64(10000)
+
+	defaultPricingMaxAge = time.Hour
+
+	defaultFinalCLTVDelta   = uint32(144)
+	defaultFeeLimitRate     = float64(0.0005)
+	defaultFeeLimitMode     = "fixed"
+	defaultEarningsFraction = 0.5
 
 	defaultMinImbalance   = int64(1000)
 	defaultTransferAmount = int64(10000)
@@ -35,7 +65,7 @@ const (
 
 func rpcPort(network string) string {
 	switch network {
-	case "mainnet":
+	case "mainnet", "regtest", "simnet", "signet":
 		{
 			return "10009"
 		}
@@ -50,33 +80,110 @@ func rpcPort(network string) string {
 	}
 }
 
+// checkNetwork returns an error unless lnd supports the network on the
+// chain.
+func checkNetwork(chain, network string) error {
+	networks := map[string][]string{
+		"bitcoin":  {"mainnet", "testnet", "regtest", "simnet", "signet"},
+		"litecoin": {"mainnet", "testnet", "regtest", "simnet"},
+	}
+	supported, ok := networks[chain]
+	if !ok {
+		return fmt.Errorf("unknown chain %q, use bitcoin or litecoin", chain)
+	}
+	for _, nn := range supported {
+		if nn == network {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s network %q, use one of %s",
+		chain, network, strings.Join(supported, ", "))
+}
+
+// lndtoolFile returns the name of lndtool's config or database file for
+// the chain and network.  Bitcoin keeps the names from before other
+// chains were supported.
+func lndtoolFile(chain, network, ext string) string {
+	if chain == defaultChain {
+		return "lndtool-" + network + ext
+	}
+	return "lndtool-" + chain + "-" + network + ext
+}
+
+// macaroonPath returns where lnd keeps the macaroon for the chain and
+// network.
+func macaroonPath(lndDir, chain, network string) string {
+	return filepath.Join(
+		lndDir, "data", "chain", chain, network, defaultMacaroonFilename,
+	)
+}
+
 var (
 	defaultLndDir     = btcutil.AppDataDir("lnd", false)
 	defaultLndToolDir = btcutil.AppDataDir("lndtool", false)
 	defaultConfigFile = filepath.Join(
-		defaultLndToolDir, "lndtool-"+defaultNetwork+".conf")
+		defaultLndToolDir, lndtoolFile(defaultChain, defaultNetwork, ".conf"))
 	defaultDBFile = filepath.Join(
-		defaultLndToolDir, "lndtool-"+defaultNetwork+".db")
+		defaultLndToolDir, lndtoolFile(defaultChain, defaultNetwork, ".db"))
 	defaultTLSCertPath  = filepath.Join(defaultLndDir, defaultTLSCertFilename)
-	defaultMacaroonPath = filepath.Join(
-		defaultLndDir, "data", "chain", "bitcoin", defaultNetwork, defaultMacaroonFilename,
-	)
-	defaultRPCServer = defaultRPCHost + ":" + rpcPort(defaultNetwork)
+	defaultMacaroonPath = macaroonPath(defaultLndDir, defaultChain, defaultNetwork)
+	defaultRPCServer    = defaultRPCHost + ":" + rpcPort(defaultNetwork)
 )
 
 type channelsConfig struct {
 	StatsWindow time.Duration `long:"statswindow" description:"Time window for channel statistics"`
+	Concurrency int           `long:"concurrency" description:"Number of concurrent node and channel lookups"`
+}
+
+type sampleConfig struct {
+	Interval time.Duration `long:"interval" description:"Time between channel state samples"`
+}
+
+type cacheConfig struct {
+	TTL     time.Duration `long:"ttl" description:"Time to keep cached node and channel info"`
+	Persist bool          `long:"persist" description:"Persist cached node and channel info in the database between runs"`
+}
+
+type farsideConfig struct {
+	CostModel   string  `long:"costmodel" description:"Edge cost model" choice:"simple" choice:"realistic"`
+	RiskFactor  float64 `long:"riskfactor" description:"Cost of locked funds per block in billionths (realistic model)"`
+	AttemptCost float64 `long:"attemptcost" description:"Cost in sat of a failed payment attempt (realistic model)"`
+}
+
+type graphConfig struct {
+	CentralitySamples int `long:"centralitysamples" description:"Number of source nodes sampled to estimate betweenness centrality (0 for all)"`
+}
+
+type suggestConfig struct {
+	DistanceWeight   float64 `long:"distanceweight" description:"Weight of hop and fee distance from our node"`
+	CentralityWeight float64 `long:"centralityweight" description:"Weight of betweenness centrality"`
+	ChannelsWeight   float64 `long:"channelsweight" description:"Weight of the number of channels"`
+	CapacityWeight   float64 `long:"capacityweight" description:"Weight of total capacity"`
+	FeesWeight       float64 `long:"feesweight" description:"Weight of a low median fee rate"`
+	AgeWeight        float64 `long:"ageweight" description:"Weight of node age"`
+	ReachWeight      float64 `long:"reachweight" description:"Weight of address reachability (clearnet over tor)"`
+}
+
+type probeConfig struct {
+	MaxAge    time.Duration `long:"maxage" description:"Trust probed liquidity bounds for this long"`
+	Precision int64         `long:"precision" description:"Stop probing when the liquidity is known to within this many sat"`
+}
+
+type pricingConfig struct {
+	MaxAge time.Duration `long:"maxage" description:"Reuse cached loop prices for this long"`
 }
 
 type rebalanceConfig struct {
-	FinalCLTVDelta uint32  `long:"finalcltvdelta" description:"Final CLTV delta"`
-	FeeLimitRate   float64 `long:"feelimitrate" description:"Limit fees to this rate"`
+	FinalCLTVDelta   uint32  `long:"finalcltvdelta" description:"Final CLTV delta"`
+	FeeLimitRate     float64 `long:"feelimitrate" description:"Limit fees to this rate"`
+	FeeLimitMode     string  `long:"feelimitmode" description:"Use the fixed fee limit rate or derive it from the destination channel's earnings" choice:"fixed" choice:"earnings"`
+	EarningsFraction float64 `long:"earningsfraction" description:"Fraction of the destination channel's outbound fee rate to pay (earnings mode)"`
 }
 
 type recommendConfig struct {
-	SrcChanTarget     []uint64      `long:"srcchantarget" description:"Adds channel to source target list (default: all)"`
-	DstChanTarget     []uint64      `long:"dstchantarget" description:"Adds channel to destination target list (default: all)"`
-	PeerNodeBlacklist []string      `long:"peernodeblacklist" description:"Adds node to peers to skip"`
+	SrcChanTarget     []chanArg     `long:"srcchantarget" description:"Adds channel, or all channels of a peer, to source target list (default: all)"`
+	DstChanTarget     []chanArg     `long:"dstchantarget" description:"Adds channel, or all channels of a peer, to destination target list (default: all)"`
+	PeerNodeBlacklist []string      `long:"peernodeblacklist" description:"Adds node to peers to skip, by pubkey, pubkey prefix, alias or channel"`
 	MinImbalance      int64         `long:"minimbalance" description:"Minimum imbalance to consider rebalancing"`
 	TransferAmount    int64         `long:"transferamount" description:"Size of rebalance transfers"`
 	RetryInhibit      time.Duration `long:"retryinhibit" description:"Inhibit retrying failed loops for this long"`
@@ -84,47 +191,244 @@ type recommendConfig struct {
 
 type config struct {
 	Verbose    bool   `long:"verbose" description:"Verbose output"`
-	Network    string `long:"network" description:"Network (mainnet, testnet, ...)"`
+	Network    string `long:"network" description:"Network (mainnet, testnet, regtest, simnet, signet)"`
+	Chain      string `long:"chain" description:"Chain (bitcoin, litecoin)"`
 	LndDir     string `long:"lnddir" description:"The base directory that contains lnd's data, logs, configuration file, etc."`
 	LndToolDir string `long:"lndtooldir" description:"The base directory that contains lndtool's data, logs, configuration file, etc."`
 	ConfigFile string `long:"C" long:"configfile" description:"Path to configuration file"`
 	DBFile     string `long:"dbfile" description:"Path to database file"`
 
-	TLSCertPath string `long:"tlscertpath" description:"Path to read the TLS certificate for lnd's RPC and REST services"`
+	TLSCertPath string `long:"tlscertpath" env:"LNDTOOL_TLSCERTPATH" description:"Path to read the TLS certificate for lnd's RPC and REST services"`
+	TLSCert     string `long:"tlscert" env:"LNDTOOL_TLSCERT" description:"TLS certificate as PEM, or hex or base64 encoded PEM or DER, instead of tlscertpath"`
 
-	MacaroonPath string `long:"macaroonpath" description:"path to macaroon file"`
-	RPCServer    string `long:"rpcserver" description:"host:port of ln daemon"`
+	MacaroonPath          string `long:"macaroonpath" env:"LNDTOOL_MACAROONPATH" description:"path to macaroon file"`
+	Macaroon              string `long:"macaroon" env:"LNDTOOL_MACAROON" description:"Hex or base64 encoded macaroon, instead of macaroonpath"`
+	ReadOnlyMacaroonPath  string `long:"readonlymacaroonpath" env:"LNDTOOL_READONLYMACAROONPATH" description:"Macaroon file for the commands which only read, instead of macaroonpath"`
+	RebalanceMacaroonPath string `long:"rebalancemacaroonpath" env:"LNDTOOL_REBALANCEMACAROONPATH" description:"Macaroon file for the commands which send payments, instead of macaroonpath"`
+	MacaroonFD            int    `long:"macaroonfd" env:"LNDTOOL_MACAROONFD" description:"Read the macaroon from this file descriptor, instead of macaroonpath"`
+	RPCServer             string `long:"rpcserver" env:"LNDTOOL_RPCSERVER" description:"host:port of ln daemon"`
+	LndConnect            string `long:"lndconnect" env:"LNDTOOL_LNDCONNECT" description:"lndconnect://host:port?cert=...&macaroon=... URI, instead of rpcserver, the TLS certificate and the macaroon"`
+
+	ChanIdFormat string `long:"chanid-format" description:"Show channels as uint64 IDs, short channel IDs (BLOCKxTXxOUT) or channel points" choice:"uint64" choice:"scid" choice:"chanpoint"`
+
+	Node     string `long:"node" description:"Use the [node.<name>] profile from the configuration file"`
+	AllNodes bool   `long:"all-nodes" description:"Combine the results of every node profile (channels and recommend only)"`
+
+	// Node profiles from the configuration file, by name.
+	Nodes map[string]*nodeProfile
+
+	// The macaroon read from macaroonfd, which can only be read once.
+	macaroonData []byte
 
 	Channels  *channelsConfig  `group:"Channels" namespace:"channels"`
+	Cache     *cacheConfig     `group:"Cache" namespace:"cache"`
+	Sample    *sampleConfig    `group:"Sample" namespace:"sample"`
+	Farside   *farsideConfig   `group:"Farside" namespace:"farside"`
+	Graph     *graphConfig     `group:"Graph" namespace:"graph"`
+	Suggest   *suggestConfig   `group:"Suggest" namespace:"suggest"`
+	Probe     *probeConfig     `group:"Probe" namespace:"probe"`
+	Pricing   *pricingConfig   `group:"Pricing" namespace:"pricing"`
 	Rebalance *rebalanceConfig `group:"Rebalance" namespace:"rebalance"`
 	Recommend *recommendConfig `group:"Recommend" namespace:"recommend"`
 }
 
-var defaultCfg = config{
-	Verbose:      defaultVerbose,
-	Network:      defaultNetwork,
-	LndDir:       defaultLndDir,
-	LndToolDir:   defaultLndToolDir,
-	ConfigFile:   defaultConfigFile,
-	DBFile:       defaultDBFile,
-	TLSCertPath:  defaultTLSCertPath,
-	MacaroonPath: defaultMacaroonPath,
-	RPCServer:    defaultRPCServer,
-	Channels: &channelsConfig{
-		StatsWindow: defaultStatsWindow,
-	},
-	Rebalance: &rebalanceConfig{
-		FinalCLTVDelta: defaultFinalCLTVDelta,
-		FeeLimitRate:   defaultFeeLimitRate,
-	},
-	Recommend: &recommendConfig{
-		SrcChanTarget:     []uint64{},
-		DstChanTarget:     []uint64{},
-		PeerNodeBlacklist: []string{},
-		MinImbalance:      defaultMinImbalance,
-		TransferAmount:    defaultTransferAmount,
-		RetryInhibit:      defaultRetryInhibit,
-	},
+// A nodeProfile holds the connection settings of one lnd from a
+// [node.<name>] section of the configuration file.
+type nodeProfile struct {
+	Name         string
+	RPCServer    string
+	TLSCertPath  string
+	MacaroonPath string
+	LndConnect   string
+
+	ReadOnlyMacaroonPath  string
+	RebalanceMacaroonPath string
+}
+
+const nodeSectionPrefix = "node."
+
+// splitNodeProfiles removes the [node.<name>] sections from the
+// configuration file contents, which go-flags doesn't know about, and
+// returns them separately.
+func splitNodeProfiles(contents string) (string, map[string]*nodeProfile, error) {
+	profiles := map[string]*nodeProfile{}
+	var profile *nodeProfile
+	rest := []string{}
+	for ndx, line := range strings.Split(contents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if strings.HasPrefix(strings.ToLower(section), nodeSectionPrefix) {
+				name := section[len(nodeSectionPrefix):]
+				if name == "" || profiles[name] != nil {
+					return "", nil, fmt.Errorf(
+						"line %d: bad or duplicate node section %q", ndx+1, section)
+				}
+				profile = &nodeProfile{Name: name}
+				profiles[name] = profile
+				continue
+			}
+			profile = nil
+		}
+		if profile == nil {
+			rest = append(rest, line)
+			continue
+		}
+		if trimmed == "" || trimmed[0] == ';' || trimmed[0] == '#' {
+			continue
+		}
+		eq := strings.Index(trimmed, "=")
+		if eq < 0 {
+			return "", nil, fmt.Errorf("line %d: expected key=value", ndx+1)
+		}
+		key := strings.ToLower(strings.TrimSpace(trimmed[:eq]))
+		value := strings.TrimSpace(trimmed[eq+1:])
+		switch key {
+		case "rpcserver":
+			profile.RPCServer = value
+		case "tlscertpath":
+			profile.TLSCertPath = cleanAndExpandPath(value)
+		case "macaroonpath":
+			profile.MacaroonPath = cleanAndExpandPath(value)
+		case "lndconnect":
+			profile.LndConnect = value
+		case "readonlymacaroonpath":
+			profile.ReadOnlyMacaroonPath = cleanAndExpandPath(value)
+		case "rebalancemacaroonpath":
+			profile.RebalanceMacaroonPath = cleanAndExpandPath(value)
+		default:
+			return "", nil, fmt.Errorf(
+				"line %d: unknown node option %q", ndx+1, key)
+		}
+	}
+	return strings.Join(rest, "\n"), profiles, nil
+}
+
+// nodeNames returns the node profile names in sorted order.
+func (cfg *config) nodeNames() []string {
+	names := []string{}
+	for name := range cfg.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forNode returns a copy of the configuration using the named node
+// profile's connection settings.
+func (cfg *config) forNode(name string) (*config, error) {
+	profile := cfg.Nodes[name]
+	if profile == nil {
+		return nil, fmt.Errorf("unknown node %q, the configuration file has %v",
+			name, cfg.nodeNames())
+	}
+	nodeCfg := *cfg
+	nodeCfg.Node = name
+
+	// The profile's connection settings take precedence over the
+	// global lndconnect URI and secrets, which are meant for the
+	// default node.
+	ownMacaroon := profile.MacaroonPath != "" ||
+		profile.ReadOnlyMacaroonPath != "" ||
+		profile.RebalanceMacaroonPath != "" ||
+		profile.LndConnect != ""
+	if ownMacaroon || profile.RPCServer != "" || profile.TLSCertPath != "" {
+		nodeCfg.LndConnect = ""
+	}
+	if profile.TLSCertPath != "" || profile.LndConnect != "" {
+		nodeCfg.TLSCert = ""
+	}
+	if ownMacaroon {
+		nodeCfg.Macaroon = ""
+		nodeCfg.macaroonData = nil
+	}
+
+	if profile.RPCServer != "" {
+		nodeCfg.RPCServer = profile.RPCServer
+	}
+	if profile.TLSCertPath != "" {
+		nodeCfg.TLSCertPath = profile.TLSCertPath
+	}
+	if profile.MacaroonPath != "" {
+		nodeCfg.MacaroonPath = profile.MacaroonPath
+	}
+	if profile.LndConnect != "" {
+		nodeCfg.LndConnect = profile.LndConnect
+	}
+	if profile.ReadOnlyMacaroonPath != "" {
+		nodeCfg.ReadOnlyMacaroonPath = profile.ReadOnlyMacaroonPath
+	}
+	if profile.RebalanceMacaroonPath != "" {
+		nodeCfg.RebalanceMacaroonPath = profile.RebalanceMacaroonPath
+	}
+	return &nodeCfg, nil
+}
+
+// defaultConfig returns the defaults.  The option groups are pointers,
+// so each config gets its own.
+func defaultConfig() config {
+	return config{
+		Verbose:      defaultVerbose,
+		ChanIdFormat: defaultChanIdFormat,
+		Network:      defaultNetwork,
+		Chain:        defaultChain,
+		LndDir:       defaultLndDir,
+		LndToolDir:   defaultLndToolDir,
+		ConfigFile:   defaultConfigFile,
+		DBFile:       defaultDBFile,
+		TLSCertPath:  defaultTLSCertPath,
+		MacaroonPath: defaultMacaroonPath,
+		RPCServer:    defaultRPCServer,
+		Channels: &channelsConfig{
+			StatsWindow: defaultStatsWindow,
+			Concurrency: defaultConcurrency,
+		},
+		Cache: &cacheConfig{
+			TTL:     defaultCacheTTL,
+			Persist: defaultCachePersist,
+		},
+		Sample: &sampleConfig{
+			Interval: defaultSampleInterval,
+		},
+		Farside: &farsideConfig{
+			CostModel:   defaultCostModel,
+			RiskFactor:  defaultRiskFactor,
+			AttemptCost: defaultAttemptCost,
+		},
+		Graph: &graphConfig{
+			CentralitySamples: defaultCentralitySamples,
+		},
+		Suggest: &suggestConfig{
+			DistanceWeight:   defaultDistanceWeight,
+			CentralityWeight: defaultCentralityWeight,
+			ChannelsWeight:   defaultChannelsWeight,
+			CapacityWeight:   defaultCapacityWeight,
+			FeesWeight:       defaultFeesWeight,
+			AgeWeight:        defaultAgeWeight,
+			ReachWeight:      defaultReachWeight,
+		},
+		Probe: &probeConfig{
+			MaxAge:    defaultProbeMaxAge,
+			Precision: defaultProbePrecision,
+		},
+		Pricing: &pricingConfig{
+			MaxAge: defaultPricingMaxAge,
+		},
+		Rebalance: &rebalanceConfig{
+			FinalCLTVDelta:   defaultFinalCLTVDelta,
+			FeeLimitRate:     defaultFeeLimitRate,
+			FeeLimitMode:     defaultFeeLimitMode,
+			EarningsFraction: defaultEarningsFraction,
+		},
+		Recommend: &recommendConfig{
+			SrcChanTarget:     []chanArg{},
+			DstChanTarget:     []chanArg{},
+			PeerNodeBlacklist: []string{},
+			MinImbalance:      defaultMinImbalance,
+			TransferAmount:    defaultTransferAmount,
+			RetryInhibit:      defaultRetryInhibit,
+		},
+	}
 }
 
 func nilHandler(flags.Commander, []string) error {
@@ -134,7 +438,7 @@ func nilHandler(flags.Commander, []string) error {
 func loadConfig() (*config, error) {
 	// Pre-parse the command line options to pick up an alternative
 	// config file.
-	preCfg := defaultCfg
+	preCfg := defaultConfig()
 	preParser := flags.NewParser(&preCfg, flags.Default)
 	addCommands(preParser)
 	preParser.CommandHandler = nilHandler // disable execution on this pass
@@ -142,19 +446,22 @@ func loadConfig() (*config, error) {
 		return nil, err
 	}
 
-	// If the network has been changed on the command line update dependent
-	// defaults.
-	if preCfg.Network != defaultNetwork {
+	if err := checkNetwork(preCfg.Chain, preCfg.Network); err != nil {
+		return nil, err
+	}
+
+	// If the network or chain has been changed on the command line
+	// update dependent defaults.
+	if preCfg.Network != defaultNetwork || preCfg.Chain != defaultChain {
 		preCfg.RPCServer = defaultRPCHost + ":" + rpcPort(preCfg.Network)
 		preCfg.ConfigFile = filepath.Join(
-			defaultLndToolDir, "lndtool-"+preCfg.Network+".conf")
+			defaultLndToolDir,
+			lndtoolFile(preCfg.Chain, preCfg.Network, ".conf"))
 		preCfg.DBFile = filepath.Join(
-			defaultLndToolDir, "lndtool-"+preCfg.Network+".db")
-		preCfg.MacaroonPath = filepath.Join(
-			defaultLndDir,
-			"data", "chain", "bitcoin", preCfg.Network,
-			defaultMacaroonFilename,
-		)
+			defaultLndToolDir,
+			lndtoolFile(preCfg.Chain, preCfg.Network, ".db"))
+		preCfg.MacaroonPath = macaroonPath(
+			defaultLndDir, preCfg.Chain, preCfg.Network)
 	}
 
 	// If the config file path has not been modified by the user, then we'll
@@ -166,45 +473,61 @@ func loadConfig() (*config, error) {
 	if lndtdir != defaultLndDir {
 		if configFilePath == defaultConfigFile {
 			configFilePath = filepath.Join(
-				lndtdir, "lndtool-"+preCfg.Network+".conf")
+				lndtdir, lndtoolFile(preCfg.Chain, preCfg.Network, ".conf"))
 		}
 		preCfg.DBFile = filepath.Join(
-			lndtdir, "lndtool-"+preCfg.Network+".db")
+			lndtdir, lndtoolFile(preCfg.Chain, preCfg.Network, ".db"))
 	}
 
 	// Next, load any additional configuration options from the file.
+	// The node profile sections are split out first.
 	var configFileError error
 	postCfg := preCfg
-	if err := flags.IniParse(configFilePath, &postCfg); err != nil {
-		// If it's a parsing related error, then we'll return
-		// immediately, otherwise we can proceed as possibly the config
-		// file doesn't exist which is OK.
-		if _, ok := err.(*flags.IniError); ok {
-			return nil, err
+	postCfg.Nodes = map[string]*nodeProfile{}
+	contents, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		// The config file doesn't have to exist.
+		configFileError = err
+	} else {
+		rest, profiles, err := splitNodeProfiles(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", configFilePath, err)
 		}
+		postCfg.Nodes = profiles
 
-		configFileError = err
+		iniParser := flags.NewIniParser(flags.NewParser(&postCfg, flags.Default))
+		if err := iniParser.Parse(strings.NewReader(rest)); err != nil {
+			// If it's a parsing related error, then we'll return
+			// immediately.
+			if _, ok := err.(*flags.IniError); ok {
+				return nil, err
+			}
+
+			configFileError = err
+		}
 	}
 
 	// Finally, parse the remaining command line options again to ensure
 	// they take precedence.
 	parser := flags.NewParser(&postCfg, flags.Default)
 	addCommands(parser)
-	_, err := parser.Parse()
+	_, err = parser.Parse()
 	if err != nil {
 		return nil, err
 	}
 
+	// The configuration file may have set them too.
+	if err := checkNetwork(postCfg.Chain, postCfg.Network); err != nil {
+		return nil, err
+	}
+
 	// If the provided lnd directory is not the default, we'll modify the
 	// path to all of the files and directories that will live within it.
 	lndDir := cleanAndExpandPath(postCfg.LndDir)
 	if lndDir != defaultLndDir {
 		postCfg.TLSCertPath = filepath.Join(lndDir, defaultTLSCertFilename)
-		postCfg.MacaroonPath = filepath.Join(
-			lndDir,
-			"data", "chain", "bitcoin", postCfg.Network,
-			defaultMacaroonFilename,
-		)
+		postCfg.MacaroonPath = macaroonPath(
+			lndDir, postCfg.Chain, postCfg.Network)
 	}
 
 	// If the provided lndtool directory is not the default, we'll modify the
@@ -212,7 +535,7 @@ func loadConfig() (*config, error) {
 	lndToolDir := cleanAndExpandPath(postCfg.LndToolDir)
 	if lndToolDir != defaultLndToolDir {
 		postCfg.DBFile = filepath.Join(
-			lndToolDir, "lndtool-"+preCfg.Network+".db")
+			lndToolDir, lndtoolFile(preCfg.Chain, preCfg.Network, ".db"))
 	}
 
 	// Create the lndtool directory if it doesn't already exist.
@@ -239,14 +562,42 @@ func loadConfig() (*config, error) {
 	// to use them later on.
 	postCfg.TLSCertPath = cleanAndExpandPath(postCfg.TLSCertPath)
 	postCfg.MacaroonPath = cleanAndExpandPath(postCfg.MacaroonPath)
+	postCfg.ReadOnlyMacaroonPath = cleanAndExpandPath(postCfg.ReadOnlyMacaroonPath)
+	postCfg.RebalanceMacaroonPath = cleanAndExpandPath(postCfg.RebalanceMacaroonPath)
 	postCfg.DBFile = cleanAndExpandPath(postCfg.DBFile)
 
+	// A file descriptor can only be read once, keep the macaroon for
+	// every connection.
+	if postCfg.MacaroonFD > 0 {
+		data, err := readMacaroonFD(postCfg.MacaroonFD)
+		if err != nil {
+			return nil, fmt.Errorf("macaroonfd: %v", err)
+		}
+		postCfg.macaroonData = data
+	}
+
+	// Select the node profile.
+	if postCfg.Node != "" && postCfg.AllNodes {
+		return nil, fmt.Errorf("--node and --all-nodes can't be used together")
+	}
+	if postCfg.AllNodes && len(postCfg.Nodes) == 0 {
+		return nil, fmt.Errorf(
+			"--all-nodes needs [node.<name>] sections in %s", configFilePath)
+	}
+	if postCfg.Node != "" {
+		nodeCfg, err := postCfg.forNode(postCfg.Node)
+		if err != nil {
+			return nil, err
+		}
+		postCfg = *nodeCfg
+	}
+
 	// Warn about missing config file only after all other configuration is
 	// done.  This prevents the warning on help messages and invalid
 	// options.  Note this should go directly before the return.
 	if configFileError != nil {
 		// ltndLog.Warnf("%v", configFileError)
-		fmt.Printf("warn: %v\n", configFileError)
+		fmt.Fprintf(os.Stderr, "warn: %v\n", configFileError)
 	}
 
 	return &postCfg, nil
@@ -288,31 +639,100 @@ var arguments []string = nil
 func addCommands(parser *flags.Parser) {
 	parser.AddCommand("dumpconfig",
 		"Dumps the configuration to stdout",
-		"The dumpconfig command prints the config to stdout",
+		"The dumpconfig command prints the config to stdout, as a config file lndtool can load or as JSON",
 		&dumpConfigCmd)
+	configGroup, _ := parser.AddCommand("config",
+		"Configuration commands",
+		"Configuration commands",
+		&configCmd)
+	configGroup.AddCommand("check",
+		"Checks the configuration for problems",
+		"Checks every configuration value, and the targeted channels and blacklisted nodes against lnd, reporting all problems found",
+		&configCheckCmd)
+	parser.AddCommand("bake-macaroon",
+		"Bakes a macaroon with just the permissions lndtool needs",
+		"Asks lnd to bake a macaroon allowing the read-only commands, or with --level rebalance the rebalancing commands too, and prints it in hex or writes it to a file",
+		&bakeMacaroonCmd)
 	parser.AddCommand("channels",
 		"Lists channels in tabular form",
 		"Lists channels in tabular form",
 		&listChannelsCmd)
+	parser.AddCommand("closed",
+		"Lists closed channels with lifetime accounting",
+		"Lists closed channels with lifetime forwarding volume, fees earned and rebalance fees spent",
+		&closedCmd)
+	parser.AddCommand("peers",
+		"Lists peers with their channels aggregated",
+		"Lists peers with their channels aggregated",
+		&peersCmd)
+	parser.AddCommand("sample",
+		"Records the state of every channel",
+		"Records the active state and balances of every channel in the database",
+		&sampleCmd)
+	parser.AddCommand("uptime",
+		"Reports peer uptime from the recorded samples",
+		"Reports per-peer uptime, flap count and last seen online time from the recorded samples",
+		&uptimeCmd)
+	parser.AddCommand("trend",
+		"Reports channel balance trends from the recorded samples",
+		"Reports how channel local balances drifted, the drain rate and the projected time until depletion",
+		&trendCmd)
 	parser.AddCommand("farside",
 		"Finds nodes on the far side of the connected set",
 		"Finds nodes on the far side of the connected set",
 		&farSideCmd)
+	parser.AddCommand("suggest-peers",
+		"Scores nodes as candidates for new channels",
+		"Scores nodes as candidates for new channels by distance, centrality, size, fees, age and reachability",
+		&suggestPeersCmd)
+	parser.AddCommand("probe-cost",
+		"Reports the cost of paying a destination",
+		"Reports the cheapest route fee, hop count, CLTV total and first hop for paying a destination each of several amounts",
+		&probeCostCmd)
+	parser.AddCommand("probe",
+		"Probes the liquidity of remote channels",
+		"Sends payments with an unknown payment hash to find the liquidity available on each hop of routes to target nodes",
+		&probeCmd)
+	graph, _ := parser.AddCommand("graph",
+		"Network graph commands",
+		"Network graph commands",
+		&graphCmd)
+	graph.AddCommand("stats",
+		"Reports network graph statistics and our node's rank",
+		"Reports network-wide totals and distributions, our node's rank by capacity, degree and betweenness centrality, and optionally the effect of hypothetical new channels",
+		&graphStatsCmd)
 	parser.AddCommand("rebalance",
 		"Balance a pair of channels with a loop transaction",
 		"Balance a pair of channels with a loop transaction",
 		&rebalanceCmd)
+	parser.AddCommand("rebalance-between",
+		"Rebalance one of our nodes through another",
+		"Rebalance a channel of the --from node with a loop leaving through its channel to the --to node, tallying the fees paid to our own nodes separately",
+		&rebalanceBetweenCmd)
 	parser.AddCommand("recommend",
 		"Recommend a pair of channels to rebalance",
 		"Recommend a pair of channels to rebalance",
 		&recommendCmd)
+	parser.AddCommand("pricing",
+		"Reports the cost of rebalancing each candidate pair",
+		"Reports the fee rate of the cheapest circular route for each recommended channel pair at several amounts, next to our fee rate on the destination channel",
+		&pricingCmd)
 	parser.AddCommand("autobalance",
 		"Loop balancing channels",
 		"Loop balancing channels",
 		&autoBalanceCmd)
+	parser.AddCommand("tui",
+		"Interactive channel dashboard",
+		"Shows the channels, recommended loops and loop history, refreshing periodically, and rebalances between channels selected with enter",
+		&tuiCmd)
+	parser.AddCommand("serve",
+		"HTTP/JSON API server",
+		"Serves the channels, peers, recommendations and loop history as JSON, and rebalances on POST /rebalance, for clients presenting the token",
+		&serveCmd)
 }
 
 type DumpConfigCmd struct {
+	Format string `long:"format" description:"Output format" choice:"ini" choice:"json" default:"ini"`
 }
 
 var dumpConfigCmd DumpConfigCmd
@@ -324,11 +744,62 @@ func (cmd *DumpConfigCmd) Execute(args []string) error {
 }
 
 func (cmd *DumpConfigCmd) RunCommand() error {
-	spew.Dump(gCfg)
+	return dumpConfig(cmd.Format)
+}
+
+type ConfigCmd struct {
+}
+
+var configCmd ConfigCmd
+
+type ConfigCheckCmd struct {
+}
+
+var configCheckCmd ConfigCheckCmd
+
+func (cmd *ConfigCheckCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
 	return nil
 }
 
+func (cmd *ConfigCheckCmd) RunCommand() error {
+	return configCheck()
+}
+
+type BakeMacaroonCmd struct {
+	Level  string `long:"level" description:"Commands the macaroon is for" choice:"readonly" choice:"rebalance" default:"rebalance"`
+	Output string `long:"output" description:"Write the macaroon to this file instead of printing it in hex"`
+}
+
+var bakeMacaroonCmd BakeMacaroonCmd
+
+func (cmd *BakeMacaroonCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *BakeMacaroonCmd) RunCommand() error {
+	return bakeMacaroon(cmd.Level, cmd.Output)
+}
+
 type ListChannelsCmd struct {
+	Sort            string `long:"sort" description:"Sort channels by this column" choice:"chanid" choice:"imbalance" choice:"capacity" choice:"local" choice:"fwd-in" choice:"fwd-out" choice:"fees" choice:"alias" choice:"age" default:"chanid"`
+	Reverse         bool   `long:"reverse" description:"Reverse the sort order"`
+	Active          bool   `long:"active" description:"Only show active channels"`
+	Inactive        bool   `long:"inactive" description:"Only show inactive channels"`
+	Disabled        bool   `long:"disabled" description:"Only show channels we have disabled"`
+	Private         bool   `long:"private" description:"Only show private channels"`
+	Peer            string `long:"peer" description:"Only show channels to peers matching this pubkey prefix or alias regex"`
+	MinCapacity     int64  `long:"min-capacity" description:"Only show channels with at least this capacity"`
+	ImbalancedAbove int64  `long:"imbalanced-above" description:"Only show channels with an absolute imbalance above this"`
+}
+
+// Filtered returns true if any of the filter options are set.
+func (cmd *ListChannelsCmd) Filtered() bool {
+	return cmd.Active || cmd.Inactive || cmd.Disabled || cmd.Private ||
+		cmd.Peer != "" || cmd.MinCapacity > 0 || cmd.ImbalancedAbove > 0
 }
 
 var listChannelsCmd ListChannelsCmd
@@ -340,11 +811,109 @@ func (cmd *ListChannelsCmd) Execute(args []string) error {
 }
 
 func (cmd *ListChannelsCmd) RunCommand() error {
-	listChannels()
+	if cmd.Active && cmd.Inactive {
+		return fmt.Errorf("--active and --inactive are mutually exclusive")
+	}
+	return listChannels(cmd)
+}
+
+func (cmd *ListChannelsCmd) RunAllNodes() error {
+	if cmd.Active && cmd.Inactive {
+		return fmt.Errorf("--active and --inactive are mutually exclusive")
+	}
+	return listChannelsAllNodes(cmd)
+}
+
+type ClosedCmd struct {
+}
+
+var closedCmd ClosedCmd
+
+func (cmd *ClosedCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *ClosedCmd) RunCommand() error {
+	listClosedChannels()
 	return nil
 }
 
+type PeersCmd struct {
+	Sort string `long:"sort" description:"Sort peers by this column" choice:"capacity" choice:"imbalance" choice:"fees" choice:"alias" default:"capacity"`
+}
+
+var peersCmd PeersCmd
+
+func (cmd *PeersCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *PeersCmd) RunCommand() error {
+	listPeers(cmd.Sort)
+	return nil
+}
+
+type SampleCmd struct {
+	Loop bool `long:"loop" description:"Keep sampling every sample.interval"`
+}
+
+var sampleCmd SampleCmd
+
+func (cmd *SampleCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *SampleCmd) RunCommand() error {
+	runSampler(cmd.Loop)
+	return nil
+}
+
+type UptimeCmd struct {
+	Windows []time.Duration `long:"window" description:"Report over this window, may be repeated (default: 24h, 168h, 720h)"`
+}
+
+var uptimeCmd UptimeCmd
+
+func (cmd *UptimeCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *UptimeCmd) RunCommand() error {
+	uptimeReport(cmd.Windows)
+	return nil
+}
+
+type TrendCmd struct {
+	Chan   chanArg       `long:"chan" description:"Show the samples for this channel"`
+	Window time.Duration `long:"window" description:"Report over this window" default:"168h"`
+}
+
+var trendCmd TrendCmd
+
+func (cmd *TrendCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *TrendCmd) RunCommand() error {
+	chanId, err := cmd.Chan.resolve()
+	if err != nil {
+		return err
+	}
+	return trendReport(cmd.Window, chanId)
+}
+
 type FarSideCmd struct {
+	SimulateOpen []string `long:"simulate-open" description:"Simulate opening a channel, <pubkey>:<capacity>[:<feerate>], may be repeated"`
 }
 
 var farSideCmd FarSideCmd
@@ -356,14 +925,125 @@ func (cmd *FarSideCmd) Execute(args []string) error {
 }
 
 func (cmd *FarSideCmd) RunCommand() error {
+	if len(cmd.SimulateOpen) > 0 {
+		return simulateOpens(cmd.SimulateOpen)
+	}
 	farSide()
 	return nil
 }
 
+type SuggestPeersCmd struct {
+	Count int `short:"n" long:"count" description:"Number of candidates to show" default:"20"`
+}
+
+var suggestPeersCmd SuggestPeersCmd
+
+func (cmd *SuggestPeersCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *SuggestPeersCmd) RunCommand() error {
+	return suggestPeers(cmd.Count)
+}
+
+type ProbeCostCmd struct {
+	Dest    string `long:"dest" description:"Destination node pubkey" required:"true"`
+	Amounts string `long:"amounts" description:"Comma separated amounts, k and M suffixes allowed" default:"10k,100k,1M"`
+	JSON    bool   `long:"json" description:"Output JSON"`
+}
+
+var probeCostCmd ProbeCostCmd
+
+func (cmd *ProbeCostCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *ProbeCostCmd) RunCommand() error {
+	return probeCost(cmd.Dest, cmd.Amounts, cmd.JSON)
+}
+
+type ProbeCmd struct {
+	Dest      []string `long:"dest" description:"Probe the route to this node, may be repeated"`
+	Peer      []string `long:"peer" description:"Probe every channel of this peer (pubkey, pubkey prefix, alias or channel), may be repeated"`
+	MaxAmount int64    `long:"max-amount" description:"Largest amount to probe (default: the route's smallest capacity)"`
+}
+
+var probeCmd ProbeCmd
+
+func (cmd *ProbeCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *ProbeCmd) RunCommand() error {
+	return probe(cmd.Dest, cmd.Peer, cmd.MaxAmount)
+}
+
+type TuiCmd struct {
+	Refresh time.Duration `long:"refresh" description:"Time between refreshes" default:"30s"`
+}
+
+var tuiCmd TuiCmd
+
+func (cmd *TuiCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *TuiCmd) RunCommand() error {
+	return runTui(cmd.Refresh)
+}
+
+type ServeCmd struct {
+	Listen    string `long:"listen" description:"Address to listen on" default:"localhost:8090"`
+	Token     string `long:"token" description:"Token clients must send as Authorization: Bearer <token>" env:"LNDTOOL_SERVE_TOKEN"`
+	TokenFile string `long:"tokenfile" description:"Read the token from this file instead"`
+}
+
+var serveCmd ServeCmd
+
+func (cmd *ServeCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *ServeCmd) RunCommand() error {
+	return serve(cmd.Listen, cmd.Token, cmd.TokenFile)
+}
+
+type GraphCmd struct {
+}
+
+var graphCmd GraphCmd
+
+type GraphStatsCmd struct {
+	With     []string `long:"with" description:"Show our centrality with a hypothetical channel to this pubkey, may be repeated"`
+	Capacity int64    `long:"capacity" description:"Capacity of the hypothetical channels" default:"1000000"`
+}
+
+var graphStatsCmd GraphStatsCmd
+
+func (cmd *GraphStatsCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *GraphStatsCmd) RunCommand() error {
+	return graphStats(cmd.With, cmd.Capacity)
+}
+
 type RebalanceCmd struct {
-	Amount      int64  `short:"a" long:"amount" description:"Amount to transfer" required:"true"`
-	Source      uint64 `short:"s" long:"source" description:"Source channel" required:"true"`
-	Destination uint64 `short:"d" long:"destination" description:"Destination channel" required:"true"`
+	Amount      int64   `short:"a" long:"amount" description:"Amount to transfer" required:"true"`
+	Source      chanArg `short:"s" long:"source" description:"Source channel, or peer to use the channel with the most local balance" required:"true"`
+	Destination chanArg `short:"d" long:"destination" description:"Destination channel, or peer to use the channel with the most remote balance" required:"true"`
 }
 
 var rebalanceCmd RebalanceCmd
@@ -375,10 +1055,37 @@ func (cmd *RebalanceCmd) Execute(args []string) error {
 }
 
 func (cmd *RebalanceCmd) RunCommand() error {
-	doRebalance(cmd.Amount, cmd.Source, cmd.Destination)
+	src, err := cmd.Source.resolveBest(mostLocal)
+	if err != nil {
+		return err
+	}
+	dst, err := cmd.Destination.resolveBest(mostRemote)
+	if err != nil {
+		return err
+	}
+	doRebalance(cmd.Amount, src, dst, chanFeeLimitRate(cmd.Amount, dst))
 	return nil
 }
 
+type RebalanceBetweenCmd struct {
+	From        string  `long:"from" description:"Node profile to rebalance" required:"true"`
+	To          string  `long:"to" description:"Node profile to loop through" required:"true"`
+	Amount      int64   `short:"a" long:"amount" description:"Amount to transfer (default: recommend.transferamount)"`
+	Destination chanArg `short:"d" long:"destination" description:"Destination channel or peer (default: the channel most short of local balance)"`
+}
+
+var rebalanceBetweenCmd RebalanceBetweenCmd
+
+func (cmd *RebalanceBetweenCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
+	return nil
+}
+
+func (cmd *RebalanceBetweenCmd) RunCommand() error {
+	return rebalanceBetween(cmd.From, cmd.To, cmd.Amount, cmd.Destination)
+}
+
 type RecommendCmd struct {
 	DoIt bool `short:"d" long:"doit" description:"Execute the recommended rebalance command"`
 }
@@ -392,10 +1099,31 @@ func (cmd *RecommendCmd) Execute(args []string) error {
 }
 
 func (cmd *RecommendCmd) RunCommand() error {
-	recommend(cmd.DoIt)
+	_, err := recommend(cmd.DoIt)
+	return err
+}
+
+func (cmd *RecommendCmd) RunAllNodes() error {
+	return recommendAllNodes(cmd.DoIt)
+}
+
+type PricingCmd struct {
+	Amounts string `long:"amounts" description:"Comma separated amounts, k and M suffixes allowed" default:"10k,100k,1M"`
+	Refresh bool   `long:"refresh" description:"Ignore cached prices"`
+}
+
+var pricingCmd PricingCmd
+
+func (cmd *PricingCmd) Execute(args []string) error {
+	command = cmd
+	arguments = args
 	return nil
 }
 
+func (cmd *PricingCmd) RunCommand() error {
+	return pricing(cmd.Amounts, cmd.Refresh)
+}
+
 type AutoBalanceCmd struct {
 }
 
@@ -409,9 +1137,12 @@ func (cmd *AutoBalanceCmd) Execute(args []string) error {
 
 func (cmd *AutoBalanceCmd) RunCommand() error {
 	for {
-		if !recommend(true) {
-			break
+		rebalanced, err := recommend(true)
+		if err != nil {
+			return err
+		}
+		if !rebalanced {
+			return nil
 		}
 	}
-	return nil
 }
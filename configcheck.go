@@ -0,0 +1,396 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gookit/color"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Options which only make sense on the command line, or hold secrets,
+// are left out of dumps.
+var dumpOmitted = map[string]bool{
+	"configfile": true,
+	"node":       true,
+	"all-nodes":  true,
+	"tlscert":    true,
+	"macaroon":   true,
+	"macaroonfd": true,
+	"lndconnect": true,
+}
+
+// configGroups returns the option groups of the configuration, the
+// application options first.
+func configGroups(cfg *config) []*flags.Group {
+	parser := flags.NewParser(cfg, flags.None)
+	main := parser.Groups()[0]
+	return append([]*flags.Group{main}, main.Groups()...)
+}
+
+// optionStrings returns the option's value as written in a config
+// file, one string per value of a list option.
+func optionStrings(option *flags.Option) []string {
+	val := reflect.ValueOf(option.Value())
+	if val.Kind() == reflect.Slice {
+		strs := []string{}
+		for ndx := 0; ndx < val.Len(); ndx++ {
+			strs = append(strs, fmt.Sprint(val.Index(ndx).Interface()))
+		}
+		return strs
+	}
+	return []string{fmt.Sprint(option.Value())}
+}
+
+// defaultOptionStrings returns the default of each option by config
+// file key, as optionStrings formats it.
+func defaultOptionStrings() map[string][]string {
+	cfg := defaultConfig()
+	defaults := map[string][]string{}
+	for _, group := range configGroups(&cfg) {
+		for _, option := range group.Options() {
+			defaults[option.LongNameWithNamespace()] = optionStrings(option)
+		}
+	}
+	return defaults
+}
+
+// profileOptions returns the node profile's settings by config file key.
+func profileOptions(profile *nodeProfile) map[string]string {
+	opts := map[string]string{}
+	for key, value := range map[string]string{
+		"rpcserver":             profile.RPCServer,
+		"tlscertpath":           profile.TLSCertPath,
+		"macaroonpath":          profile.MacaroonPath,
+		"lndconnect":            profile.LndConnect,
+		"readonlymacaroonpath":  profile.ReadOnlyMacaroonPath,
+		"rebalancemacaroonpath": profile.RebalanceMacaroonPath,
+	} {
+		if value != "" {
+			opts[key] = value
+		}
+	}
+	return opts
+}
+
+func sortedKeys(opts map[string]string) []string {
+	keys := []string{}
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dumpIni writes the configuration as a config file which loadConfig
+// reads back.  Options left at their defaults are commented out.
+func dumpIni(out io.Writer, cfg *config) {
+	defaults := defaultOptionStrings()
+	for ndx, group := range configGroups(cfg) {
+		if ndx > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "[%s]\n", group.ShortDescription)
+		for _, option := range group.Options() {
+			if dumpOmitted[option.LongName] {
+				continue
+			}
+			fmt.Fprintf(out, "\n; %s\n", option.Description)
+			name := option.LongNameWithNamespace()
+			strs := optionStrings(option)
+			if reflect.DeepEqual(strs, defaults[name]) {
+				if len(strs) == 0 {
+					fmt.Fprintf(out, "; %s=\n", name)
+				}
+				for _, str := range strs {
+					fmt.Fprintf(out, "; %s=%s\n", name, str)
+				}
+				continue
+			}
+			for _, str := range strs {
+				fmt.Fprintf(out, "%s=%s\n", name, str)
+			}
+		}
+	}
+
+	for _, name := range cfg.nodeNames() {
+		fmt.Fprintf(out, "\n[%s%s]\n", nodeSectionPrefix, name)
+		opts := profileOptions(cfg.Nodes[name])
+		for _, key := range sortedKeys(opts) {
+			fmt.Fprintf(out, "%s=%s\n", key, opts[key])
+		}
+	}
+}
+
+// dumpJSON writes the configuration as JSON keyed like the config file,
+// with the groups and node profiles nested.
+func dumpJSON(out io.Writer, cfg *config) error {
+	doc := map[string]interface{}{}
+	for ndx, group := range configGroups(cfg) {
+		values := doc
+		if ndx > 0 {
+			values = map[string]interface{}{}
+			doc[group.Namespace] = values
+		}
+		for _, option := range group.Options() {
+			if dumpOmitted[option.LongName] {
+				continue
+			}
+			value := option.Value()
+			if dur, ok := value.(time.Duration); ok {
+				value = dur.String()
+			}
+			values[option.LongName] = value
+		}
+	}
+
+	nodes := map[string]interface{}{}
+	for name, profile := range cfg.Nodes {
+		nodes[name] = profileOptions(profile)
+	}
+	doc["nodes"] = nodes
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(data))
+	return nil
+}
+
+func dumpConfig(format string) error {
+	if format == "json" {
+		return dumpJSON(os.Stdout, gCfg)
+	}
+	dumpIni(os.Stdout, gCfg)
+	return nil
+}
+
+// configProblems collects everything wrong with the configuration so
+// it can be reported at once.
+type configProblems []string
+
+func (problems *configProblems) add(option, format string, args ...interface{}) {
+	*problems = append(*problems, option+": "+fmt.Sprintf(format, args...))
+}
+
+func (problems *configProblems) checkFile(option, path string) {
+	if _, err := os.Stat(path); err != nil {
+		problems.add(option, "%v", err)
+	}
+}
+
+func isPubKey(str string) bool {
+	data, err := hex.DecodeString(str)
+	return err == nil && len(data) == 33 && (data[0] == 2 || data[0] == 3)
+}
+
+// checkConnection checks the settings lnd is reached with, the ones
+// actually used given lndconnect and the secrets take precedence.
+func (problems *configProblems) checkConnection(cfg *config) {
+	if cfg.LndConnect != "" {
+		if _, err := parseLndConnect(cfg.LndConnect); err != nil {
+			problems.add("lndconnect", "%v", err)
+		}
+		return
+	}
+
+	if cfg.TLSCert != "" {
+		if _, err := tlsCredentials(cfg.TLSCert, false); err != nil {
+			problems.add("tlscert", "%v", err)
+		}
+	} else {
+		problems.checkFile("tlscertpath", cfg.TLSCertPath)
+	}
+
+	switch {
+	case cfg.Macaroon != "":
+		if _, err := decodeSecret(cfg.Macaroon); err != nil {
+			problems.add("macaroon", "%v", err)
+		}
+	case cfg.MacaroonFD < 0:
+		problems.add("macaroonfd", "must not be negative, got %d", cfg.MacaroonFD)
+	case cfg.macaroonData == nil:
+		if cfg.ReadOnlyMacaroonPath != "" {
+			problems.checkFile("readonlymacaroonpath", cfg.ReadOnlyMacaroonPath)
+		}
+		if cfg.RebalanceMacaroonPath != "" {
+			problems.checkFile("rebalancemacaroonpath", cfg.RebalanceMacaroonPath)
+		}
+		if cfg.ReadOnlyMacaroonPath == "" || cfg.RebalanceMacaroonPath == "" {
+			problems.checkFile("macaroonpath", cfg.MacaroonPath)
+		}
+	}
+}
+
+// checkValues checks the option values without connecting to lnd.
+func (problems *configProblems) checkValues(cfg *config) {
+	if err := checkNetwork(cfg.Chain, cfg.Network); err != nil {
+		problems.add("network", "%v", err)
+	}
+	problems.checkConnection(cfg)
+
+	// The node profiles' own settings, the rest are checked above.
+	for _, name := range cfg.nodeNames() {
+		prefix := nodeSectionPrefix + name + "."
+		opts := profileOptions(cfg.Nodes[name])
+		for _, key := range sortedKeys(opts) {
+			value := opts[key]
+			switch key {
+			case "rpcserver":
+			case "lndconnect":
+				if _, err := parseLndConnect(value); err != nil {
+					problems.add(prefix+key, "%v", err)
+				}
+			default:
+				problems.checkFile(prefix+key, value)
+			}
+		}
+	}
+
+	positive := func(option string, value float64) {
+		if value <= 0 {
+			problems.add(option, "must be positive, got %v", value)
+		}
+	}
+	notNegative := func(option string, value float64) {
+		if value < 0 {
+			problems.add(option, "must not be negative, got %v", value)
+		}
+	}
+	fraction := func(option string, value float64) {
+		if value < 0 || value > 1 {
+			problems.add(option, "must be between 0 and 1, got %v", value)
+		}
+	}
+	duration := func(value time.Duration) float64 {
+		return value.Seconds()
+	}
+
+	positive("channels.statswindow", duration(cfg.Channels.StatsWindow))
+	positive("channels.concurrency", float64(cfg.Channels.Concurrency))
+	notNegative("cache.ttl", duration(cfg.Cache.TTL))
+	positive("sample.interval", duration(cfg.Sample.Interval))
+	notNegative("farside.riskfactor", cfg.Farside.RiskFactor)
+	notNegative("farside.attemptcost", cfg.Farside.AttemptCost)
+	notNegative("graph.centralitysamples", float64(cfg.Graph.CentralitySamples))
+	notNegative("suggest.distanceweight", cfg.Suggest.DistanceWeight)
+	notNegative("suggest.centralityweight", cfg.Suggest.CentralityWeight)
+	notNegative("suggest.channelsweight", cfg.Suggest.ChannelsWeight)
+	notNegative("suggest.capacityweight", cfg.Suggest.CapacityWeight)
+	notNegative("suggest.feesweight", cfg.Suggest.FeesWeight)
+	notNegative("suggest.ageweight", cfg.Suggest.AgeWeight)
+	notNegative("suggest.reachweight", cfg.Suggest.ReachWeight)
+	notNegative("probe.maxage", duration(cfg.Probe.MaxAge))
+	positive("probe.precision", float64(cfg.Probe.Precision))
+	notNegative("pricing.maxage", duration(cfg.Pricing.MaxAge))
+	positive("rebalance.finalcltvdelta", float64(cfg.Rebalance.FinalCLTVDelta))
+	fraction("rebalance.feelimitrate", cfg.Rebalance.FeeLimitRate)
+	fraction("rebalance.earningsfraction", cfg.Rebalance.EarningsFraction)
+	notNegative("recommend.minimbalance", float64(cfg.Recommend.MinImbalance))
+	positive("recommend.transferamount", float64(cfg.Recommend.TransferAmount))
+	notNegative("recommend.retryinhibit", duration(cfg.Recommend.RetryInhibit))
+}
+
+// checkNode checks the channel targets and the blacklist against the
+// connected node.
+func (problems *configProblems) checkNode(prefix string) {
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+	channels := map[uint64]*lnrpc.Channel{}
+	peers := map[string]bool{}
+	for _, chn := range rsp.Channels {
+		channels[chn.ChanId] = chn
+		peers[chn.RemotePubkey] = true
+	}
+
+	checkTargets := func(option string, targets []chanArg) {
+		for _, target := range targets {
+			chanId, err := target.resolve()
+			if err != nil {
+				problems.add(prefix+option, "%v", err)
+				continue
+			}
+			chn := channels[chanId]
+			if chn == nil {
+				problems.add(prefix+option, "%s is not one of our channels", target)
+			} else if chn.Private {
+				problems.add(prefix+option,
+					"%s is private, only public channels are recommended", target)
+			}
+		}
+	}
+	checkTargets("recommend.srcchantarget", gCfg.Recommend.SrcChanTarget)
+	checkTargets("recommend.dstchantarget", gCfg.Recommend.DstChanTarget)
+
+	for _, name := range gCfg.Recommend.PeerNodeBlacklist {
+		if !isPubKey(name) {
+			if _, err := resolvePeer(name, rsp.Channels); err != nil {
+				problems.add(prefix+"recommend.peernodeblacklist", "%v", err)
+			}
+			continue
+		}
+		pubKey := name
+		if peers[pubKey] {
+			continue
+		}
+		_, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{PubKey: pubKey})
+		if err != nil {
+			problems.add(prefix+"recommend.peernodeblacklist",
+				"%s is not in the graph", pubKey)
+		} else {
+			problems.add(prefix+"recommend.peernodeblacklist",
+				"%s has no channel with us", pubKey)
+		}
+	}
+}
+
+// configCheck reports every problem with the configuration, checking
+// it against the node, or each node profile with --all-nodes.
+func configCheck() error {
+	problems := configProblems{}
+	problems.checkValues(gCfg)
+
+	baseCfg := gCfg
+	defer func() { gCfg = baseCfg }()
+	names := []string{""}
+	if gCfg.AllNodes {
+		names = gCfg.nodeNames()
+	}
+	for _, name := range names {
+		gCfg = baseCfg
+		prefix := ""
+		var err error
+		if name == "" {
+			err = connect()
+		} else {
+			prefix = fmt.Sprintf("[%s] ", name)
+			err = connectNode(name)
+		}
+		if err != nil {
+			problems.add(prefix+"rpcserver", "can't check against lnd: %v", err)
+			continue
+		}
+		problems.checkNode(prefix)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("configuration OK")
+		return nil
+	}
+	for _, problem := range problems {
+		color.Red.Println(problem)
+	}
+	return fmt.Errorf("%d configuration problems", len(problems))
+}
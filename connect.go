@@ -0,0 +1,282 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/macaroons"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/macaroon.v2"
+)
+
+// gNode is the identity pubkey of the node we're connected to, the
+// database rows of each node are tagged with it.
+var gNode string
+
+var gConn *grpc.ClientConn
+
+// connect dials the lnd in gCfg and points the global clients at it.
+func connect() error {
+	if gConn != nil {
+		gConn.Close()
+		gConn = nil
+	}
+
+	rpcServer := gCfg.RPCServer
+	tlsCert := gCfg.TLSCert
+	macaroonStr := gCfg.Macaroon
+	if gCfg.LndConnect != "" {
+		uri, err := parseLndConnect(gCfg.LndConnect)
+		if err != nil {
+			return err
+		}
+		rpcServer = uri.Host
+		tlsCert = uri.Cert
+		macaroonStr = uri.Macaroon
+	}
+
+	tlsCreds, err := tlsCredentials(tlsCert, gCfg.LndConnect != "")
+	if err != nil {
+		return fmt.Errorf("Cannot get node tls credentials: %v", err)
+	}
+
+	perms := commandPermissions(command)
+	macaroonBytes, err := readMacaroon(macaroonStr, permissionsMacaroonPath(perms))
+	if err != nil {
+		return fmt.Errorf("Cannot read macaroon: %v", err)
+	}
+
+	mac := &macaroon.Macaroon{}
+	if err = mac.UnmarshalBinary(macaroonBytes); err != nil {
+		return fmt.Errorf("Cannot unmarshal macaroon: %v", err)
+	}
+	if err = checkPermissions(mac, perms); err != nil {
+		return err
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(tlsCreds),
+		grpc.WithBlock(),
+		grpc.WithPerRPCCredentials(macaroons.NewMacaroonCredential(mac)),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(1 * 1024 * 1024 * 50)),
+	}
+
+	conn, err := grpc.Dial(rpcServer, opts...)
+	if err != nil {
+		return fmt.Errorf("cannot dial to lnd: %v", err)
+	}
+	gConn = conn
+	gClient = lnrpc.NewLightningClient(conn)
+	gRouter = routerrpc.NewRouterClient(conn)
+	gCtx = context.Background()
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("GetInfo failed: %v", err)
+	}
+	gNode = info.IdentityPubkey
+
+	// Forget what we learned about the previous node.
+	edgeLimit = map[*lnrpc.EdgeLocator]int64{}
+	lastSampleTime = time.Time{}
+	chanPoints = nil
+
+	// Rows written before nodes were tagged belong to the node the
+	// database served, the one configured outside the node profiles.
+	if gCfg.Node == "" {
+		adoptUntaggedRows(gNode)
+	}
+	return nil
+}
+
+// An lndconnect URI carries the RPC server and, encoded in base64url,
+// the DER certificate and the macaroon.  The cert is left out when lnd
+// has a certificate from a public CA.
+type lndConnectURI struct {
+	Host     string
+	Cert     string
+	Macaroon string
+}
+
+func parseLndConnect(str string) (*lndConnectURI, error) {
+	uri, err := url.Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf("bad lndconnect URI: %v", err)
+	}
+	if uri.Scheme != "lndconnect" || uri.Host == "" {
+		return nil, fmt.Errorf(
+			"bad lndconnect URI: expected lndconnect://host:port?...")
+	}
+	query := uri.Query()
+	if query.Get("macaroon") == "" {
+		return nil, fmt.Errorf("bad lndconnect URI: no macaroon")
+	}
+	return &lndConnectURI{
+		Host:     uri.Host,
+		Cert:     query.Get("cert"),
+		Macaroon: query.Get("macaroon"),
+	}, nil
+}
+
+// decodeSecret decodes a hex or base64 (standard or URL, padded or
+// not) encoded value.
+func decodeSecret(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	if data, err := hex.DecodeString(str); err == nil {
+		return data, nil
+	}
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if data, err := enc.DecodeString(str); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("not hex or base64")
+}
+
+// tlsCredentials uses the certificate if given, the system roots for an
+// lndconnect URI without one, otherwise the certificate file.
+func tlsCredentials(cert string, lndConnect bool) (credentials.TransportCredentials, error) {
+	if cert == "" {
+		if lndConnect {
+			return credentials.NewClientTLSFromCert(nil, ""), nil
+		}
+		return credentials.NewClientTLSFromFile(gCfg.TLSCertPath, "")
+	}
+
+	pemBytes := []byte(cert)
+	if !strings.Contains(cert, "-----BEGIN") {
+		data, err := decodeSecret(cert)
+		if err != nil {
+			return nil, fmt.Errorf("bad certificate: %v", err)
+		}
+		pemBytes = data
+	}
+
+	pool := x509.NewCertPool()
+	if bytes.Contains(pemBytes, []byte("-----BEGIN")) {
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("bad PEM certificate")
+		}
+	} else {
+		parsed, err := x509.ParseCertificate(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("bad DER certificate: %v", err)
+		}
+		pool.AddCert(parsed)
+	}
+	return credentials.NewClientTLSFromCert(pool, ""), nil
+}
+
+// readMacaroonFD reads the macaroon from the file descriptor.
+func readMacaroonFD(fd int) ([]byte, error) {
+	file := os.NewFile(uintptr(fd), "macaroonfd")
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	// Accept the macaroon encoded as text too.
+	if decoded, err := decodeSecret(string(data)); err == nil {
+		return decoded, nil
+	}
+	return data, nil
+}
+
+// readMacaroon decodes the macaroon if given, otherwise uses the one
+// read from the file descriptor or reads the macaroon file.
+func readMacaroon(encoded, path string) ([]byte, error) {
+	if encoded != "" {
+		return decodeSecret(encoded)
+	}
+	if gCfg.macaroonData != nil {
+		return gCfg.macaroonData, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// connectNode connects to the named node profile.
+func connectNode(name string) error {
+	nodeCfg, err := gCfg.forNode(name)
+	if err != nil {
+		return err
+	}
+	gCfg = nodeCfg
+	if err := connect(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// withNode connects to the named node profile for the duration of fn.
+func withNode(name string, fn func() error) error {
+	baseCfg := gCfg
+	defer func() { gCfg = baseCfg }()
+	if err := connectNode(name); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// forEachNode calls fn connected to each node profile in turn.
+func forEachNode(fn func(name string) error) error {
+	for _, name := range gCfg.nodeNames() {
+		err := withNode(name, func() error { return fn(name) })
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An allNodesCommand combines the results of every node profile for
+// --all-nodes.
+type allNodesCommand interface {
+	RunAllNodes() error
+}
+
+// runCommand runs the command against the configured node, or against
+// every node profile with --all-nodes.
+func runCommand() error {
+	// These connect to the nodes they need.
+	switch command.(type) {
+	case *RebalanceBetweenCmd, *ConfigCheckCmd:
+		return command.RunCommand()
+	}
+	if commandPermissions(command) == nil {
+		return command.RunCommand()
+	}
+
+	if !gCfg.AllNodes {
+		if err := connect(); err != nil {
+			return err
+		}
+		return command.RunCommand()
+	}
+
+	cmd, ok := command.(allNodesCommand)
+	if !ok {
+		return fmt.Errorf("--all-nodes is only supported by the channels and recommend commands")
+	}
+	return cmd.RunAllNodes()
+}
@@ -6,6 +6,8 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/lightningnetwork/lnd/lnrpc"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -26,6 +28,10 @@ type LoopAttempt struct {
 	Amount       int64
 	FeeLimitRate float64
 	Outcome      LoopAttemptOutcome
+	FeeMsat      int64 // fees paid, successful loops only
+
+	InternalFeeMsat int64 // part of FeeMsat paid to our own nodes
+	BetweenNodes    bool  // made by rebalance-between
 }
 
 func NewLoopAttempt(
@@ -37,6 +43,7 @@ func NewLoopAttempt(
 	amount int64,
 	feeLimitRate float64,
 	outcome LoopAttemptOutcome,
+	feeMsat int64,
 ) *LoopAttempt {
 	return &LoopAttempt{
 		Tstamp:       tstamp,
@@ -47,6 +54,8 @@ func NewLoopAttempt(
 		Amount:       amount,
 		FeeLimitRate: feeLimitRate,
 		Outcome:      outcome,
+		FeeMsat:      feeMsat,
+		BetweenNodes: len(gOurNodes) > 0,
 	}
 }
 
@@ -56,6 +65,10 @@ func openDatabase() {
 	if err != nil {
 		panic(fmt.Sprintf("sql.Open failed: %v", err))
 	}
+
+	// The channel lookups run concurrently and sqlite doesn't like
+	// concurrent writers.
+	gDB.SetMaxOpenConns(1)
 }
 
 func createDatabase() {
@@ -69,7 +82,11 @@ func createDatabase() {
 	        dst_node STRING,
 	        amount INTEGER,
 	        fee_limit_rate FLOAT,
-	        outcome INTEGER
+	        outcome INTEGER,
+	        fee_msat INTEGER DEFAULT 0,
+	        our_node STRING DEFAULT '',
+	        internal_fee_msat INTEGER DEFAULT 0,
+	        between_nodes INTEGER DEFAULT 0
         )
     `, `
         CREATE INDEX IF NOT EXISTS loop_attempt_tstamp_ndx
@@ -86,6 +103,77 @@ func createDatabase() {
     `, `
         CREATE INDEX IF NOT EXISTS loop_attempt_dst_node_ndx
             ON loop_attempt(dst_node)
+    `, `
+        CREATE TABLE IF NOT EXISTS chan_sample (
+	        id INTEGER PRIMARY KEY,
+	        tstamp INTEGER,
+	        chan_id INTEGER,
+	        remote_node STRING,
+	        active INTEGER,
+	        disabled INTEGER,
+	        capacity INTEGER,
+	        local_balance INTEGER,
+	        remote_balance INTEGER,
+	        our_node STRING DEFAULT ''
+        )
+    `, `
+        CREATE INDEX IF NOT EXISTS chan_sample_tstamp_ndx
+            ON chan_sample(tstamp)
+    `, `
+        CREATE INDEX IF NOT EXISTS chan_sample_chan_id_ndx
+            ON chan_sample(chan_id)
+    `, `
+        CREATE INDEX IF NOT EXISTS chan_sample_remote_node_ndx
+            ON chan_sample(remote_node)
+    `, `
+        CREATE TABLE IF NOT EXISTS node_info_cache (
+	        pubkey STRING PRIMARY KEY,
+	        tstamp INTEGER,
+	        alias STRING,
+	        total_capacity INTEGER,
+	        num_channels INTEGER
+        )
+    `, `
+        CREATE TABLE IF NOT EXISTS chan_info_cache (
+	        chan_id INTEGER PRIMARY KEY,
+	        tstamp INTEGER,
+	        edge BLOB
+        )
+    `, `
+        CREATE TABLE IF NOT EXISTS edge_liquidity (
+	        chan_id INTEGER,
+	        reverse INTEGER,
+	        from_node STRING,
+	        to_node STRING,
+	        tstamp INTEGER,
+	        min_sat INTEGER,
+	        max_sat INTEGER,
+	        PRIMARY KEY (chan_id, reverse)
+        )
+    `, `
+        CREATE INDEX IF NOT EXISTS edge_liquidity_from_node_ndx
+            ON edge_liquidity(from_node)
+    `, `
+        CREATE TABLE IF NOT EXISTS loop_price (
+	        src_chan INTEGER,
+	        dst_chan INTEGER,
+	        amount INTEGER,
+	        tstamp INTEGER,
+	        fee_msat INTEGER,
+	        num_hops INTEGER,
+	        our_node STRING DEFAULT '',
+	        PRIMARY KEY (our_node, src_chan, dst_chan, amount)
+        )
+    `, `
+        CREATE TABLE IF NOT EXISTS rebalance_request (
+	        our_node STRING,
+	        idem_key STRING,
+	        tstamp INTEGER,
+	        request STRING,
+	        status INTEGER,
+	        response STRING,
+	        PRIMARY KEY (our_node, idem_key)
+        )
     `}
 
 	for _, cmd := range cmds {
@@ -98,6 +186,142 @@ func createDatabase() {
 			panic(fmt.Sprintf("stmt.Exec \"%s\" failed: %v", cmd, err))
 		}
 	}
+
+	// Columns added after the tables were first created.
+	addColumnIfMissing("loop_attempt", "fee_msat", "INTEGER DEFAULT 0")
+	addColumnIfMissing("loop_attempt", "our_node", "STRING DEFAULT ''")
+	addColumnIfMissing("chan_sample", "our_node", "STRING DEFAULT ''")
+	addColumnIfMissing("loop_price", "our_node", "STRING DEFAULT ''")
+	addColumnIfMissing("loop_attempt", "internal_fee_msat", "INTEGER DEFAULT 0")
+	addColumnIfMissing("loop_attempt", "between_nodes", "INTEGER DEFAULT 0")
+
+	// Prices were keyed by the loop alone, so nodes sharing a channel
+	// overwrote each other's.
+	if !inPrimaryKey("loop_price", "our_node") {
+		rekeyLoopPrice()
+	}
+}
+
+// Tables with rows tagged by the identity pubkey of our node.
+var nodeTables = []string{"loop_attempt", "chan_sample", "loop_price"}
+
+// adoptUntaggedRows tags the rows written before rows were tagged
+// with node.
+func adoptUntaggedRows(node string) {
+	for _, table := range nodeTables {
+		cmd := fmt.Sprintf(
+			"UPDATE %s SET our_node = ? WHERE our_node = ''", table)
+		_, err := gDB.Exec(cmd, node)
+		if err != nil {
+			panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+		}
+	}
+}
+
+func addColumnIfMissing(table, column, decl string) {
+	query := fmt.Sprintf("PRAGMA table_info(%s)", table)
+	rows, err := gDB.Query(query)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	found := false
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			panic(err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	rows.Close()
+
+	if !found {
+		cmd := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s",
+			table, column, decl)
+		_, err = gDB.Exec(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+		}
+	}
+}
+
+// inPrimaryKey returns whether the column is part of the table's
+// primary key.
+func inPrimaryKey(table, column string) bool {
+	query := fmt.Sprintf("PRAGMA table_info(%s)", table)
+	rows, err := gDB.Query(query)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			panic(err)
+		}
+		if name == column && pk > 0 {
+			found = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return found
+}
+
+// rekeyLoopPrice rebuilds the loop_price table with our_node in the
+// primary key, which sqlite can't alter in place.
+func rekeyLoopPrice() {
+	tx, err := gDB.Begin()
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Begin failed: %v", err))
+	}
+	cmds := []string{`
+        ALTER TABLE loop_price RENAME TO loop_price_old
+    `, `
+        CREATE TABLE loop_price (
+	        src_chan INTEGER,
+	        dst_chan INTEGER,
+	        amount INTEGER,
+	        tstamp INTEGER,
+	        fee_msat INTEGER,
+	        num_hops INTEGER,
+	        our_node STRING DEFAULT '',
+	        PRIMARY KEY (our_node, src_chan, dst_chan, amount)
+        )
+    `, `
+        INSERT INTO loop_price (
+            src_chan, dst_chan, amount, tstamp, fee_msat, num_hops, our_node
+        )
+        SELECT src_chan, dst_chan, amount, tstamp, fee_msat, num_hops, our_node
+        FROM loop_price_old
+    `, `
+        DROP TABLE loop_price_old
+    `}
+	for _, cmd := range cmds {
+		if _, err := tx.Exec(cmd); err != nil {
+			tx.Rollback()
+			panic(fmt.Sprintf("tx.Exec \"%s\" failed: %v", cmd, err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(fmt.Sprintf("tx.Commit failed: %v", err))
+	}
 }
 
 func insertLoopAttempt(attempt *LoopAttempt) {
@@ -108,9 +332,13 @@ func insertLoopAttempt(attempt *LoopAttempt) {
             dst_chan, dst_node,
             amount,
             fee_limit_rate,
-            outcome
+            outcome,
+            fee_msat,
+            our_node,
+            internal_fee_msat,
+            between_nodes
         )
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `
 	stmt, err := gDB.Prepare(cmd)
 	if err != nil {
@@ -123,12 +351,287 @@ func insertLoopAttempt(attempt *LoopAttempt) {
 		attempt.Amount,
 		attempt.FeeLimitRate,
 		attempt.Outcome,
+		attempt.FeeMsat,
+		gNode,
+		attempt.InternalFeeMsat,
+		attempt.BetweenNodes,
 	)
 	if err != nil {
 		panic(fmt.Sprintf("stmt.Exec \"%s\" failed: %v", cmd, err))
 	}
 }
 
+// selectLoopAttempts returns the most recent loop attempts, newest
+// first.
+func selectLoopAttempts(limit int) []*LoopAttempt {
+	query := `
+        SELECT tstamp, src_chan, src_node, dst_chan, dst_node, amount,
+            fee_limit_rate, outcome, fee_msat, internal_fee_msat
+        FROM loop_attempt
+        WHERE our_node = ?
+        ORDER BY tstamp DESC
+        LIMIT ?
+    `
+	rows, err := gDB.Query(query, gNode, limit)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	defer rows.Close()
+
+	retval := []*LoopAttempt{}
+	for rows.Next() {
+		attempt := &LoopAttempt{}
+		err = rows.Scan(
+			&attempt.Tstamp,
+			&attempt.SrcChan, &attempt.SrcNode,
+			&attempt.DstChan, &attempt.DstNode,
+			&attempt.Amount,
+			&attempt.FeeLimitRate,
+			&attempt.Outcome,
+			&attempt.FeeMsat,
+			&attempt.InternalFeeMsat,
+		)
+		if err != nil {
+			panic(err)
+		}
+		retval = append(retval, attempt)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return retval
+}
+
+// A RebalanceRequest records a rebalance the API server was asked for,
+// so retries with the same idempotency key get the same response.
+// Status is zero while the rebalance is running.
+type RebalanceRequest struct {
+	Tstamp   int64
+	Request  string
+	Status   int
+	Response string
+}
+
+func selectRebalanceRequest(key string) *RebalanceRequest {
+	query := `
+        SELECT tstamp, request, status, response
+        FROM rebalance_request
+        WHERE our_node = ? AND idem_key = ?
+    `
+	row := gDB.QueryRow(query, gNode, key)
+	req := RebalanceRequest{}
+	switch err := row.Scan(
+		&req.Tstamp, &req.Request, &req.Status, &req.Response,
+	); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return &req
+	default:
+		panic(err)
+	}
+}
+
+func insertRebalanceRequest(key string, req *RebalanceRequest) {
+	cmd := `
+        INSERT INTO rebalance_request (
+            our_node, idem_key, tstamp, request, status, response
+        )
+        VALUES (?, ?, ?, ?, ?, ?)
+    `
+	_, err := gDB.Exec(cmd,
+		gNode, key, req.Tstamp, req.Request, req.Status, req.Response)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+func updateRebalanceRequest(key string, status int, response string) {
+	cmd := `
+        UPDATE rebalance_request
+        SET status = ?, response = ?
+        WHERE our_node = ? AND idem_key = ?
+    `
+	_, err := gDB.Exec(cmd, status, response, gNode, key)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+func selectNodeInfoCache(pubkey string) *NodeInfoEntry {
+	query := `
+        SELECT tstamp, alias, total_capacity, num_channels
+        FROM node_info_cache
+        WHERE pubkey = ?
+    `
+	row := gDB.QueryRow(query, pubkey)
+	entry := NodeInfoEntry{}
+	switch err := row.Scan(
+		&entry.Tstamp, &entry.Alias,
+		&entry.TotalCapacity, &entry.NumChannels,
+	); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return &entry
+	default:
+		panic(err)
+	}
+}
+
+func upsertNodeInfoCache(pubkey string, entry *NodeInfoEntry) {
+	cmd := `
+        INSERT OR REPLACE INTO node_info_cache (
+            pubkey, tstamp, alias, total_capacity, num_channels
+        )
+        VALUES (?, ?, ?, ?, ?)
+    `
+	_, err := gDB.Exec(cmd,
+		pubkey, entry.Tstamp, entry.Alias,
+		entry.TotalCapacity, entry.NumChannels,
+	)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+func selectChanInfoCache(chanId uint64) *ChanInfoEntry {
+	query := `
+        SELECT tstamp, edge FROM chan_info_cache WHERE chan_id = ?
+    `
+	row := gDB.QueryRow(query, chanId)
+	var tstamp int64
+	var blob []byte
+	switch err := row.Scan(&tstamp, &blob); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		//
+	default:
+		panic(err)
+	}
+	edge := &lnrpc.ChannelEdge{}
+	if err := proto.Unmarshal(blob, edge); err != nil {
+		// Treat an undecodable entry as a miss, it will be replaced.
+		return nil
+	}
+	return &ChanInfoEntry{Tstamp: tstamp, Edge: edge}
+}
+
+func upsertChanInfoCache(chanId uint64, entry *ChanInfoEntry) {
+	blob, err := proto.Marshal(entry.Edge)
+	if err != nil {
+		panic(fmt.Sprintf("proto.Marshal failed: %v", err))
+	}
+	cmd := `
+        INSERT OR REPLACE INTO chan_info_cache (chan_id, tstamp, edge)
+        VALUES (?, ?, ?)
+    `
+	_, err = gDB.Exec(cmd, chanId, entry.Tstamp, blob)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+func deleteChanInfoCache(chanId uint64) {
+	cmd := `DELETE FROM chan_info_cache WHERE chan_id = ?`
+	_, err := gDB.Exec(cmd, chanId)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+func upsertEdgeLiquidity(liq *EdgeLiquidity) {
+	cmd := `
+        INSERT OR REPLACE INTO edge_liquidity (
+            chan_id, reverse, from_node, to_node, tstamp, min_sat, max_sat
+        )
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `
+	_, err := gDB.Exec(cmd,
+		liq.ChanId, liq.Reverse, liq.FromNode, liq.ToNode,
+		liq.Tstamp, liq.MinSat, liq.MaxSat,
+	)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
+// selectEdgeLiquidity returns the liquidity bounds probed since tstamp,
+// optionally only those of edges sent from fromNode.
+func selectEdgeLiquidity(tstamp int64, fromNode string) []*EdgeLiquidity {
+	query := `
+        SELECT chan_id, reverse, from_node, to_node, tstamp, min_sat, max_sat
+        FROM edge_liquidity
+        WHERE tstamp >= ?
+    `
+	args := []interface{}{tstamp}
+	if fromNode != "" {
+		query += ` AND from_node = ?`
+		args = append(args, fromNode)
+	}
+	query += ` ORDER BY chan_id, reverse`
+
+	rows, err := gDB.Query(query, args...)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	defer rows.Close()
+
+	retval := []*EdgeLiquidity{}
+	for rows.Next() {
+		liq := &EdgeLiquidity{}
+		err = rows.Scan(
+			&liq.ChanId, &liq.Reverse, &liq.FromNode, &liq.ToNode,
+			&liq.Tstamp, &liq.MinSat, &liq.MaxSat,
+		)
+		if err != nil {
+			panic(err)
+		}
+		retval = append(retval, liq)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return retval
+}
+
+func selectLoopPrice(srcChan, dstChan uint64, amount int64) *LoopPrice {
+	query := `
+        SELECT tstamp, fee_msat, num_hops
+        FROM loop_price
+        WHERE src_chan = ? AND dst_chan = ? AND amount = ? AND our_node = ?
+    `
+	row := gDB.QueryRow(query, srcChan, dstChan, amount, gNode)
+	price := LoopPrice{SrcChan: srcChan, DstChan: dstChan, Amount: amount}
+	switch err := row.Scan(&price.Tstamp, &price.FeeMsat, &price.NumHops); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return &price
+	default:
+		panic(err)
+	}
+}
+
+func upsertLoopPrice(price *LoopPrice) {
+	cmd := `
+        INSERT OR REPLACE INTO loop_price (
+            src_chan, dst_chan, amount, tstamp, fee_msat, num_hops, our_node
+        )
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `
+	_, err := gDB.Exec(cmd,
+		price.SrcChan, price.DstChan, price.Amount,
+		price.Tstamp, price.FeeMsat, price.NumHops, gNode,
+	)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Exec \"%s\" failed: %v", cmd, err))
+	}
+}
+
 //
 // 	os.Exit(0)
 //
@@ -159,8 +662,9 @@ func recentlyFailed(srcChan, dstChan uint64, tstamp int64, amount int64, feeLimi
           AND amount <= ?
           AND fee_limit_rate >= ?
           AND outcome != 0
+          AND our_node = ?
     `
-	row := gDB.QueryRow(query, srcChan, dstChan, tstamp, amount, feeLimitRate)
+	row := gDB.QueryRow(query, srcChan, dstChan, tstamp, amount, feeLimitRate, gNode)
 	var count int
 	switch err := row.Scan(&count); err {
 	case sql.ErrNoRows:
@@ -191,15 +695,15 @@ func chanStats(theChan uint64) *ChannelStats {
 
 func doChanStats(theChan uint64, isRcv bool, retval *ChannelStats) {
 
-	query := `SELECT amount, outcome FROM loop_attempt `
+	query := `SELECT amount, outcome FROM loop_attempt WHERE our_node = ?`
 
 	if isRcv {
-		query += ` WHERE dst_chan = ?`
+		query += ` AND dst_chan = ?`
 	} else {
-		query += ` WHERE src_chan = ?`
+		query += ` AND src_chan = ?`
 	}
 
-	rows, err := gDB.Query(query, theChan)
+	rows, err := gDB.Query(query, gNode, theChan)
 	if err != nil {
 		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
 	}
@@ -235,3 +739,172 @@ func doChanStats(theChan uint64, isRcv bool, retval *ChannelStats) {
 		panic(err)
 	}
 }
+
+// rebalanceFeesMsat returns the fees paid by successful loops into the
+// channel.  Each loop is charged to its destination, the channel it
+// was bought for, so totals over channels count it once.
+func rebalanceFeesMsat(theChan uint64) int64 {
+	query := `
+        SELECT COALESCE(SUM(fee_msat), 0) FROM loop_attempt
+        WHERE dst_chan = ?
+          AND outcome = 0
+          AND our_node = ?
+    `
+	row := gDB.QueryRow(query, theChan, gNode)
+	var feeMsat int64
+	if err := row.Scan(&feeMsat); err != nil {
+		panic(err)
+	}
+	return feeMsat
+}
+
+type LoopFeeTally struct {
+	Loops           int
+	Amount          int64
+	FeeMsat         int64
+	InternalFeeMsat int64
+}
+
+// loopFeeTally totals the successful rebalance-between loops out
+// through a channel to srcNode.
+func loopFeeTally(srcNode string) *LoopFeeTally {
+	query := `
+        SELECT COUNT(*),
+               COALESCE(SUM(amount), 0),
+               COALESCE(SUM(fee_msat), 0),
+               COALESCE(SUM(internal_fee_msat), 0)
+        FROM loop_attempt
+        WHERE src_node = ? AND outcome = 0 AND our_node = ?
+            AND between_nodes = 1
+    `
+	row := gDB.QueryRow(query, srcNode, gNode)
+	tally := &LoopFeeTally{}
+	err := row.Scan(
+		&tally.Loops, &tally.Amount, &tally.FeeMsat, &tally.InternalFeeMsat)
+	if err != nil {
+		panic(err)
+	}
+	return tally
+}
+
+type LoopNodeStats struct {
+	Attempts  int
+	Successes int
+}
+
+// loopStatsByNode counts loop attempts and successes for each node
+// which was the source or destination peer of a loop.
+func loopStatsByNode() map[string]*LoopNodeStats {
+	query := `
+        SELECT node, COUNT(*), SUM(CASE WHEN outcome = 0 THEN 1 ELSE 0 END)
+        FROM (
+            SELECT src_node AS node, outcome FROM loop_attempt
+            WHERE our_node = ?
+            UNION ALL
+            SELECT dst_node AS node, outcome FROM loop_attempt
+            WHERE our_node = ?
+        )
+        GROUP BY node
+    `
+	rows, err := gDB.Query(query, gNode, gNode)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	defer rows.Close()
+
+	retval := map[string]*LoopNodeStats{}
+	for rows.Next() {
+		var node string
+		stats := &LoopNodeStats{}
+		err = rows.Scan(&node, &stats.Attempts, &stats.Successes)
+		if err != nil {
+			panic(err)
+		}
+		retval[node] = stats
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return retval
+}
+
+func insertChanSamples(samples []*ChanSample) {
+	tx, err := gDB.Begin()
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Begin failed: %v", err))
+	}
+	cmd := `
+        INSERT INTO chan_sample (
+            tstamp,
+            chan_id, remote_node,
+            active, disabled,
+            capacity, local_balance, remote_balance,
+            our_node
+        )
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `
+	stmt, err := tx.Prepare(cmd)
+	if err != nil {
+		panic(fmt.Sprintf("tx.Prepare \"%s\" failed: %v", cmd, err))
+	}
+	defer stmt.Close()
+	for _, sample := range samples {
+		_, err = stmt.Exec(
+			sample.Tstamp,
+			sample.ChanId, sample.RemoteNode,
+			sample.Active, sample.Disabled,
+			sample.Capacity, sample.LocalBalance, sample.RemoteBalance,
+			gNode,
+		)
+		if err != nil {
+			tx.Rollback()
+			panic(fmt.Sprintf("stmt.Exec \"%s\" failed: %v", cmd, err))
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic(fmt.Sprintf("tx.Commit failed: %v", err))
+	}
+}
+
+// selectChanSamples returns the samples taken since tstamp in time
+// order, for a single channel if theChan is non-zero.
+func selectChanSamples(tstamp int64, theChan uint64) []*ChanSample {
+	query := `
+        SELECT tstamp, chan_id, remote_node, active, disabled,
+               capacity, local_balance, remote_balance
+        FROM chan_sample
+        WHERE tstamp > ? AND our_node = ?
+    `
+	args := []interface{}{tstamp, gNode}
+	if theChan != 0 {
+		query += ` AND chan_id = ?`
+		args = append(args, theChan)
+	}
+	query += ` ORDER BY tstamp, chan_id`
+
+	rows, err := gDB.Query(query, args...)
+	if err != nil {
+		panic(fmt.Sprintf("gDB.Query \"%s\" failed: %v", query, err))
+	}
+	defer rows.Close()
+
+	retval := []*ChanSample{}
+	for rows.Next() {
+		sample := &ChanSample{}
+		err = rows.Scan(
+			&sample.Tstamp, &sample.ChanId, &sample.RemoteNode,
+			&sample.Active, &sample.Disabled,
+			&sample.Capacity, &sample.LocalBalance, &sample.RemoteBalance,
+		)
+		if err != nil {
+			panic(err)
+		}
+		retval = append(retval, sample)
+	}
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+	return retval
+}
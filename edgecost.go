@@ -0,0 +1,84 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// An EdgeCost returns the cost in sat of sending xfersize from the
+// node across the edge using the node's policy, and false if the edge
+// can't carry the payment at all.
+type EdgeCost func(from *Node, edge *Edge, policy *lnrpc.RoutingPolicy) (float64, bool)
+
+// edgeCostModel returns the cost function named by farside.costmodel.
+func edgeCostModel(name string) EdgeCost {
+	switch name {
+	case "realistic":
+		return newRealisticEdgeCost(recentLiquidity())
+	default:
+		return simpleEdgeCost
+	}
+}
+
+// simpleEdgeCost only considers the fee and whether the channel is
+// bigger than the payment.
+func simpleEdgeCost(from *Node, edge *Edge, policy *lnrpc.RoutingPolicy) (float64, bool) {
+	if edge.Capacity <= xfersize {
+		return 0, false
+	}
+	return (float64(policy.FeeBaseMsat) / 1e3) +
+		(xfersize * (float64(policy.FeeRateMilliMsat) / 1e6)), true
+}
+
+// newRealisticEdgeCost returns a cost function which also honors the
+// HTLC limits of the policy, charges for the time the funds are locked
+// up by the CLTV delta, and charges for the expected number of failed
+// attempts.  The success probability assumes the liquidity is uniformly
+// distributed over the capacity, or between the bounds our probes and
+// failed rebalances found for the edge.
+func newRealisticEdgeCost(liquidity liquidityBounds) EdgeCost {
+	riskFactor := gCfg.Farside.RiskFactor
+	attemptCost := gCfg.Farside.AttemptCost
+
+	return func(from *Node, edge *Edge, policy *lnrpc.RoutingPolicy) (float64, bool) {
+		amtMsat := int64(xfersize * 1000)
+		if amtMsat < policy.MinHtlc {
+			return 0, false
+		}
+		if policy.MaxHtlcMsat != 0 && uint64(amtMsat) > policy.MaxHtlcMsat {
+			return 0, false
+		}
+		if edge.Capacity <= xfersize {
+			return 0, false
+		}
+
+		fee := (float64(policy.FeeBaseMsat) / 1e3) +
+			(xfersize * (float64(policy.FeeRateMilliMsat) / 1e6))
+
+		// Time value of the locked funds, risk factor is in
+		// billionths per block like lnd's.
+		lockCost := xfersize * float64(policy.TimeLockDelta) *
+			riskFactor / 1e9
+
+		prob := 1 - float64(xfersize)/float64(edge.Capacity)
+		key := edgeKey{edge.ChannelId, edge.Node2Pub == from.PubKey}
+		if liq := liquidity[key]; liq != nil {
+			switch {
+			case xfersize <= liq.MinSat:
+				prob = 1
+			case xfersize >= liq.MaxSat:
+				return 0, false
+			default:
+				prob = float64(liq.MaxSat-xfersize) /
+					float64(liq.MaxSat-liq.MinSat)
+			}
+		}
+		if prob <= 0 {
+			return 0, false
+		}
+		failCost := attemptCost * (1/prob - 1)
+
+		return fee + lockCost + failCost, true
+	}
+}
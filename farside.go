@@ -25,6 +25,11 @@ type Node struct {
 	Peers         []*Node
 	NumHops       int
 	CumulativeFee float64
+
+	// The cheapest path found by Propagate arrives from Prev over
+	// Prev.Edges[PrevNdx].
+	Prev    *Node
+	PrevNdx int
 }
 
 func NewNode(nn *lnrpc.LightningNode) *Node {
@@ -33,6 +38,7 @@ func NewNode(nn *lnrpc.LightningNode) *Node {
 		Edges:         []*Edge{},
 		NumHops:       -1,
 		CumulativeFee: 0,
+		PrevNdx:       -1,
 	}
 }
 
@@ -96,17 +102,25 @@ func (nn ByUtility) Less(ii, jj int) bool {
 
 const xfersize = 1000 * 1000 // 1e6 sat = $80
 
-func (node *Node) Propagate(hops int, fee float64) {
+func (node *Node) Propagate(hops int, fee float64, cost EdgeCost) {
+	node.propagate(nil, -1, hops, fee, cost)
+}
+
+func (node *Node) propagate(prev *Node, prevNdx int, hops int, fee float64, cost EdgeCost) {
 	if node.NumHops == -1 {
 		// First time we've seen this node.
 		node.NumHops = hops
 		node.CumulativeFee = fee
+		node.Prev = prev
+		node.PrevNdx = prevNdx
 	} else {
 		// We've seen this node before, is this a cheaper path?
 		if fee < node.CumulativeFee {
 			// This is a cheaper path
 			node.NumHops = hops
 			node.CumulativeFee = fee
+			node.Prev = prev
+			node.PrevNdx = prevNdx
 			// Fall through and repropogate it.
 		} else {
 			// This path is not cheaper, bail.
@@ -121,23 +135,27 @@ func (node *Node) Propagate(hops int, fee float64) {
 		edge := node.Edges[ndx]
 
 		if policy != nil {
-			// Does this edge have enough capacity?
-			if edge.Capacity > xfersize {
-				// Compute the fee to use this channel.
-				nextfee := fee +
-					(float64(policy.FeeBaseMsat) / 1e3) +
-					(xfersize * (float64(policy.FeeRateMilliMsat) / 1e6))
-				peer.Propagate(nexthop, nextfee)
+			// Can this edge carry the payment and what does it cost?
+			if edgeCost, ok := cost(node, edge, policy); ok {
+				peer.propagate(node, ndx, nexthop, fee+edgeCost, cost)
 			}
 		}
 	}
 }
 
-func farSide() {
+type Graph struct {
+	Nodes   map[string]*Node
+	Edges   map[uint64]*Edge
+	OurNode *Node
+	Height  uint32   // current block height
+	Cost    EdgeCost // edge cost model used by Propagate
+}
+
+// loadGraph builds the channel graph as seen by our node.
+func loadGraph() (*Graph, error) {
 	rsp, err := gClient.DescribeGraph(gCtx, &lnrpc.ChannelGraphRequest{})
 	if err != nil {
-		fmt.Println("Cannot describe graph from node:", err)
-		return
+		return nil, fmt.Errorf("Cannot describe graph from node: %v", err)
 	}
 
 	nodes := map[string]*Node{}
@@ -159,8 +177,85 @@ func farSide() {
 		panic(fmt.Sprint("GetInfo failed: %v\n", err))
 	}
 
-	ournode := nodes[info.IdentityPubkey]
-	ournode.Propagate(0, 0)
+	return &Graph{
+		Nodes:   nodes,
+		Edges:   edges,
+		OurNode: nodes[info.IdentityPubkey],
+		Height:  info.BlockHeight,
+		Cost:    edgeCostModel(gCfg.Farside.CostModel),
+	}, nil
+}
+
+// A PathHop is one channel of a path found by Propagate, with the
+// sending node's policy.
+type PathHop struct {
+	From   *Node
+	Edge   *Edge
+	Policy *lnrpc.RoutingPolicy
+	To     *Node
+}
+
+// PathTo returns the hops of the cheapest path from the node Propagate
+// started at to node, or nil if the node wasn't reached.
+func (node *Node) PathTo() []*PathHop {
+	if node.NumHops < 1 {
+		return nil
+	}
+	path := []*PathHop{}
+	for nn := node; nn.Prev != nil; nn = nn.Prev {
+		path = append([]*PathHop{{
+			From:   nn.Prev,
+			Edge:   nn.Prev.Edges[nn.PrevNdx],
+			Policy: nn.Prev.Policy[nn.PrevNdx],
+			To:     nn,
+		}}, path...)
+	}
+	return path
+}
+
+// ResetDistances forgets the results of a previous Propagate.
+func (graph *Graph) ResetDistances() {
+	for _, node := range graph.Nodes {
+		node.NumHops = -1
+		node.CumulativeFee = 0
+		node.Prev = nil
+		node.PrevNdx = -1
+	}
+}
+
+// Default policy for hypothetical channels.
+const (
+	virtualTimeLockDelta = 40
+	virtualFeeBaseMsat   = 1000
+)
+
+// AddVirtualChannel adds a hypothetical channel between our node and
+// peer, using the same policy in both directions.
+func (graph *Graph) AddVirtualChannel(peer *Node, capacity, feeRate int64) {
+	edge := &Edge{ChannelEdge: lnrpc.ChannelEdge{
+		Node1Pub: graph.OurNode.PubKey,
+		Node2Pub: peer.PubKey,
+		Capacity: capacity,
+	}}
+	policy := &lnrpc.RoutingPolicy{
+		TimeLockDelta:    virtualTimeLockDelta,
+		FeeBaseMsat:      virtualFeeBaseMsat,
+		FeeRateMilliMsat: feeRate,
+	}
+	graph.OurNode.AddEdge(edge, policy, peer)
+	peer.AddEdge(edge, policy, graph.OurNode)
+}
+
+func farSide() {
+	graph, err := loadGraph()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	nodes := graph.Nodes
+
+	ournode := graph.OurNode
+	ournode.Propagate(0, 0, graph.Cost)
 
 	if gCfg.Verbose {
 		all := []*Node{}
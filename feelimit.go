@@ -0,0 +1,58 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// feeLimitRate returns the most we'll pay to move amt into the
+// destination channel, as a fraction of amt.  In earnings mode it is
+// a fraction of our outbound fee rate on the channel, scaled down when
+// the channel forwarded less than amt out over the stats window, so a
+// rebalance doesn't cost more than the channel can earn back.  The
+// stats are only needed in earnings mode.
+func feeLimitRate(amt int64, dstChanId uint64, dstNode string, stats *FwdStats) float64 {
+	if gCfg.Rebalance.FeeLimitMode != "earnings" {
+		return gCfg.Rebalance.FeeLimitRate
+	}
+
+	policy := hopPolicy(dstChanId, dstNode)
+	if policy == nil {
+		return 0
+	}
+	rate := float64(policy.FeeRateMilliMsat) / 1e6 *
+		gCfg.Rebalance.EarningsFraction
+
+	volume := uint64(0)
+	if elem := (*stats)[dstChanId]; elem != nil {
+		volume = elem.AmountSnd
+	}
+	if int64(volume) < amt {
+		rate *= float64(volume) / float64(amt)
+	}
+	return rate
+}
+
+// chanFeeLimitRate is feeLimitRate for a single rebalance.
+func chanFeeLimitRate(amt int64, dstChanId uint64) float64 {
+	if gCfg.Rebalance.FeeLimitMode != "earnings" {
+		return gCfg.Rebalance.FeeLimitRate
+	}
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		panic(fmt.Sprint("GetInfo failed:", err))
+	}
+	chanInfo, err := getChanInfo(dstChanId)
+	if err != nil {
+		panic(fmt.Sprint("dst GetChanInfo failed:", err))
+	}
+	dstNode := chanInfo.Node1Pub
+	if dstNode == info.IdentityPubkey {
+		dstNode = chanInfo.Node2Pub
+	}
+	return feeLimitRate(amt, dstChanId, dstNode, getFwdStats())
+}
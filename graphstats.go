@@ -0,0 +1,125 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gookit/color"
+)
+
+// quantiles returns the values at the given fractions of the sorted
+// values.
+func quantiles(values []int64, fracs []float64) []int64 {
+	retval := make([]int64, len(fracs))
+	if len(values) == 0 {
+		return retval
+	}
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(ii, jj int) bool { return sorted[ii] < sorted[jj] })
+	for ndx, frac := range fracs {
+		retval[ndx] = sorted[int(frac*float64(len(sorted)-1))]
+	}
+	return retval
+}
+
+var statsQuantiles = []float64{0.1, 0.25, 0.5, 0.75, 0.9}
+
+func printQuantiles(label string, values []int64) {
+	fmt.Printf("%-24s", label)
+	for _, vv := range quantiles(values, statsQuantiles) {
+		fmt.Printf(" %10d", vv)
+	}
+	fmt.Println()
+}
+
+func graphStats(with []string, capacity int64) error {
+	graph, err := loadGraph()
+	if err != nil {
+		return err
+	}
+	if graph.OurNode == nil {
+		return fmt.Errorf("our node is not in the graph")
+	}
+
+	// Resolve the hypothetical peers before the long computations.
+	peers := []*Node{}
+	for _, pubkey := range with {
+		peer := graph.Nodes[pubkey]
+		if peer == nil {
+			return fmt.Errorf("%s is not in the graph", pubkey)
+		}
+		peers = append(peers, peer)
+	}
+
+	totalCapacity := int64(0)
+	chanSizes := []int64{}
+	for _, edge := range graph.Edges {
+		totalCapacity += edge.Capacity
+		chanSizes = append(chanSizes, edge.Capacity)
+	}
+	feeRates := []int64{}
+	feeBases := []int64{}
+	timeLocks := []int64{}
+	for _, node := range graph.Nodes {
+		for _, policy := range node.Policy {
+			feeRates = append(feeRates, policy.FeeRateMilliMsat)
+			feeBases = append(feeBases, policy.FeeBaseMsat)
+			timeLocks = append(timeLocks, int64(policy.TimeLockDelta))
+		}
+	}
+
+	color.Bold.Println("Network")
+	fmt.Printf("%-24s %10d\n", "nodes", len(graph.Nodes))
+	fmt.Printf("%-24s %10d\n", "channels", len(graph.Edges))
+	fmt.Printf("%-24s %10d\n", "enabled policies", len(feeRates))
+	fmt.Printf("%-24s %10d\n", "capacity", totalCapacity)
+	fmt.Println()
+
+	color.Bold.Printf("%-24s %10s %10s %10s %10s %10s\n",
+		"Distribution", "10%", "25%", "50%", "75%", "90%")
+	printQuantiles("channel size", chanSizes)
+	printQuantiles("fee rate (ppm)", feeRates)
+	printQuantiles("base fee (msat)", feeBases)
+	printQuantiles("time lock delta", timeLocks)
+	fmt.Println()
+
+	capacities := map[*Node]float64{}
+	degrees := map[*Node]float64{}
+	for _, node := range graph.Nodes {
+		capacities[node] = float64(node.Capacity())
+		degrees[node] = float64(node.NumChan())
+	}
+	betweenness := graph.Betweenness(gCfg.Graph.CentralitySamples)
+
+	ournode := graph.OurNode
+	color.Bold.Printf("%-24s %14s %8s\n", ournode.Alias, "Value", "Rank")
+	fmt.Printf("%-24s %14d %8d\n", "capacity",
+		ournode.Capacity(), rankOf(capacities, ournode))
+	fmt.Printf("%-24s %14d %8d\n", "degree",
+		ournode.NumChan(), rankOf(degrees, ournode))
+	fmt.Printf("%-24s %14.0f %8d\n", "betweenness",
+		betweenness[ournode], rankOf(betweenness, ournode))
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	for _, peer := range peers {
+		graph.AddVirtualChannel(peer, capacity, int64(0))
+	}
+	after := graph.Betweenness(gCfg.Graph.CentralitySamples)
+
+	fmt.Println()
+	color.Bold.Printf("With %d new channel(s)    %14s %8s\n", len(peers), "Value", "Rank")
+	for _, peer := range peers {
+		fmt.Printf("  %s %s\n", peer.PubKey, peer.Alias)
+	}
+	fmt.Printf("%-24s %14.0f %8d\n", "betweenness",
+		after[ournode], rankOf(after, ournode))
+	fmt.Printf("%-24s %+14.0f %+8d\n", "change",
+		after[ournode]-betweenness[ournode],
+		rankOf(betweenness, ournode)-rankOf(after, ournode))
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// resolvePeer returns the pubkey of the peer the name refers to, which
+// may be a pubkey, a unique pubkey prefix, the ID of a channel with the
+// peer, or the peer's alias.  Only the remote nodes of the channels are
+// considered, except full pubkeys are returned as they are.
+func resolvePeer(name string, channels []*lnrpc.Channel) (string, error) {
+	if isPubKey(name) {
+		return name, nil
+	}
+
+	var arg chanArg
+	if arg.UnmarshalFlag(name) == nil && arg.peer == "" {
+		if chanId, err := arg.resolve(); err == nil {
+			for _, chn := range channels {
+				if chn.ChanId == chanId {
+					return chn.RemotePubkey, nil
+				}
+			}
+		}
+	}
+
+	peers := []string{}
+	seen := map[string]bool{}
+	for _, chn := range channels {
+		if !seen[chn.RemotePubkey] {
+			seen[chn.RemotePubkey] = true
+			peers = append(peers, chn.RemotePubkey)
+		}
+	}
+
+	// Pubkey prefixes first, then exact aliases, then aliases
+	// containing the name.
+	lower := strings.ToLower(name)
+	matchers := []func(pubkey, alias string) bool{
+		func(pubkey, alias string) bool {
+			return strings.HasPrefix(pubkey, lower)
+		},
+		func(pubkey, alias string) bool {
+			return strings.EqualFold(alias, name)
+		},
+		func(pubkey, alias string) bool {
+			return strings.Contains(strings.ToLower(alias), lower)
+		},
+	}
+	for _, match := range matchers {
+		matches := []string{}
+		for _, peer := range peers {
+			if match(peer, probeAlias(peer)) {
+				matches = append(matches, peer)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			return matches[0], nil
+		default:
+			strs := []string{}
+			for _, peer := range matches {
+				strs = append(strs,
+					fmt.Sprintf("%s (%s)", probeAlias(peer), peer[:10]))
+			}
+			return "", fmt.Errorf("%q is ambiguous, it matches %s",
+				name, strings.Join(strs, ", "))
+		}
+	}
+	return "", fmt.Errorf("no peer matches %q", name)
+}
+
+// peerSet returns the pubkeys of the named peers.  Full pubkeys are
+// taken as they are, so nodes which aren't peers yet still match, any
+// other name must resolve to exactly one peer.
+func peerSet(names []string, channels []*lnrpc.Channel) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, name := range names {
+		pubkey, err := resolvePeer(name, channels)
+		if err != nil {
+			return nil, err
+		}
+		set[pubkey] = true
+	}
+	return set, nil
+}
+
+// allChannels returns all our open channels.
+func allChannels() []*lnrpc.Channel {
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+	return rsp.Channels
+}
+
+// mostLocal and mostRemote choose between a peer's channels, the first
+// for sending out, the second for receiving.
+func mostLocal(aa, bb *lnrpc.Channel) bool {
+	return aa.LocalBalance > bb.LocalBalance
+}
+
+func mostRemote(aa, bb *lnrpc.Channel) bool {
+	return aa.RemoteBalance > bb.RemoteBalance
+}
+
+// peerChannels returns our channels with the peer the argument names.
+func (arg chanArg) peerChannels() ([]*lnrpc.Channel, error) {
+	channels := allChannels()
+	pubkey, err := resolvePeer(arg.peer, channels)
+	if err != nil {
+		return nil, err
+	}
+	peerChans := []*lnrpc.Channel{}
+	for _, chn := range channels {
+		if chn.RemotePubkey == pubkey {
+			peerChans = append(peerChans, chn)
+		}
+	}
+	if len(peerChans) == 0 {
+		return nil, fmt.Errorf("we have no channel with %s", arg.peer)
+	}
+	return peerChans, nil
+}
+
+// resolveBest returns the channel ID like resolve, but picks the best
+// active channel by better when a peer has several.
+func (arg chanArg) resolveBest(better func(aa, bb *lnrpc.Channel) bool) (uint64, error) {
+	if arg.peer == "" {
+		return arg.resolve()
+	}
+	peerChans, err := arg.peerChannels()
+	if err != nil {
+		return 0, err
+	}
+	var best *lnrpc.Channel
+	for _, chn := range peerChans {
+		if chn.Active && (best == nil || better(chn, best)) {
+			best = chn
+		}
+	}
+	if best == nil {
+		return 0, fmt.Errorf("no active channel with %s", arg.peer)
+	}
+	return best.ChanId, nil
+}
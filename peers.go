@@ -0,0 +1,172 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// PeerRow aggregates all of our channels with a single peer.
+type PeerRow struct {
+	PubKey        string
+	Alias         string
+	NumChans      int
+	Capacity      int64
+	LocalBalance  int64
+	RemoteBalance int64
+	FwdRcv        uint64
+	FwdSnd        uint64
+	FeeMsat       uint64 // fees earned forwarding out to this peer
+	Lifetime      int64  // seconds the channels have been monitored
+	Uptime        int64  // seconds the peer was online during Lifetime
+	LoopStats     *LoopNodeStats
+}
+
+func (row *PeerRow) Imbalance() int64 {
+	return row.LocalBalance - ((row.LocalBalance + row.RemoteBalance) / 2)
+}
+
+func (row *PeerRow) UptimeFraction() float64 {
+	if row.Lifetime == 0 {
+		return 0
+	}
+	return float64(row.Uptime) / float64(row.Lifetime)
+}
+
+func (row *PeerRow) LoopSuccessRate() float64 {
+	if row.LoopStats.Attempts == 0 {
+		return 0
+	}
+	return float64(row.LoopStats.Successes) / float64(row.LoopStats.Attempts)
+}
+
+func gatherPeers() []*PeerRow {
+	fwdStats := getFwdStats()
+	loopStats := loopStatsByNode()
+
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
+		ActiveOnly:   false,
+		InactiveOnly: false,
+		PublicOnly:   false,
+		PrivateOnly:  false,
+	})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+
+	peers := map[string]*PeerRow{}
+	for _, chn := range rsp.Channels {
+		row := peers[chn.RemotePubkey]
+		if row == nil {
+			row = &PeerRow{PubKey: chn.RemotePubkey}
+			peers[chn.RemotePubkey] = row
+		}
+		row.NumChans += 1
+		row.Capacity += chn.Capacity
+		row.LocalBalance += chn.LocalBalance
+		row.RemoteBalance += chn.RemoteBalance
+		row.Lifetime += chn.Lifetime
+		row.Uptime += chn.Uptime
+
+		if chnFwdStats := (*fwdStats)[chn.ChanId]; chnFwdStats != nil {
+			row.FwdRcv += chnFwdStats.AmountRcv
+			row.FwdSnd += chnFwdStats.AmountSnd
+			row.FeeMsat += chnFwdStats.FeeMsatSnd
+		}
+	}
+
+	rows := []*PeerRow{}
+	for pubkey, row := range peers {
+		nodeInfo, err := getNodeInfo(pubkey)
+		if err == nil {
+			row.Alias = nodeInfo.Alias
+		}
+		row.LoopStats = loopStats[pubkey]
+		if row.LoopStats == nil {
+			row.LoopStats = &LoopNodeStats{}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// peerSortKeys are the columns sortPeerRows sorts by.
+var peerSortKeys = []string{"capacity", "imbalance", "fees", "alias"}
+
+func sortPeerRows(rows []*PeerRow, key string) {
+	sort.SliceStable(rows, func(ii, jj int) bool {
+		switch key {
+		case "imbalance":
+			return rows[ii].Imbalance() > rows[jj].Imbalance()
+		case "fees":
+			return rows[ii].FeeMsat > rows[jj].FeeMsat
+		case "alias":
+			return strings.ToLower(rows[ii].Alias) <
+				strings.ToLower(rows[jj].Alias)
+		default:
+			return rows[ii].Capacity > rows[jj].Capacity
+		}
+	})
+}
+
+func listPeers(sortKey string) {
+	rows := gatherPeers()
+	sortPeerRows(rows, sortKey)
+
+	color.Bold.Println("Chn  Capacity     Local    Remote  Imbalance FwdR  FwdS     Fees Uptm Loops Succ PubKey                                                             Alias")
+
+	sumChans := 0
+	sumCapacity := int64(0)
+	sumLocal := int64(0)
+	sumRemote := int64(0)
+	sumFwdRcv := uint64(0)
+	sumFwdSnd := uint64(0)
+	sumFeeMsat := uint64(0)
+	for _, row := range rows {
+		str := fmt.Sprintf("%3d %9d %9d %9d %10d %s %s %7d %3.0f%% %5d %3.0f%% %s %s",
+			row.NumChans,
+			row.Capacity,
+			row.LocalBalance,
+			row.RemoteBalance,
+			row.Imbalance(),
+			fmtAmountSci(float64(row.FwdRcv)),
+			fmtAmountSci(float64(row.FwdSnd)),
+			row.FeeMsat/1000,
+			row.UptimeFraction()*100,
+			row.LoopStats.Attempts,
+			row.LoopSuccessRate()*100,
+			abbrevPubKey(row.PubKey),
+			row.Alias,
+		)
+		if row.Lifetime > 0 && row.UptimeFraction() < 0.9 {
+			color.Yellow.Println(str)
+		} else {
+			color.Black.Println(str)
+		}
+
+		sumChans += row.NumChans
+		sumCapacity += row.Capacity
+		sumLocal += row.LocalBalance
+		sumRemote += row.RemoteBalance
+		sumFwdRcv += row.FwdRcv
+		sumFwdSnd += row.FwdSnd
+		sumFeeMsat += row.FeeMsat
+	}
+
+	color.Bold.Printf("%3d %9d %9d %9d %10d %s %s %7d  %d peers\n",
+		sumChans,
+		sumCapacity,
+		sumLocal,
+		sumRemote,
+		sumLocal-((sumLocal+sumRemote)/2),
+		fmtAmountSci(float64(sumFwdRcv)),
+		fmtAmountSci(float64(sumFwdSnd)),
+		sumFeeMsat/1000,
+		len(rows),
+	)
+}
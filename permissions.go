@@ -0,0 +1,195 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"gopkg.in/macaroon.v2"
+)
+
+// A permission is an lnd macaroon entity and action, as listed for
+// each RPC in lnd's rpcserver.go.
+type permission struct {
+	Entity string
+	Action string
+}
+
+func (perm permission) String() string {
+	return perm.Entity + ":" + perm.Action
+}
+
+// readOnlyPermissions cover GetInfo, the channel, graph and forwarding
+// queries and QueryRoutes.
+var readOnlyPermissions = []permission{
+	{"info", "read"},
+	{"offchain", "read"},
+}
+
+// rebalancePermissions add paying ourselves an invoice with SendToRoute.
+var rebalancePermissions = []permission{
+	{"info", "read"},
+	{"offchain", "read"},
+	{"offchain", "write"},
+	{"invoices", "write"},
+}
+
+// commandPermissions returns what the command needs the macaroon to
+// allow.  Commands which need nothing don't connect.
+func commandPermissions(cmd LNDToolCommand) []permission {
+	switch cmd := cmd.(type) {
+	case *DumpConfigCmd:
+		return nil
+	case *BakeMacaroonCmd:
+		return []permission{{"macaroon", "generate"}}
+	case *RebalanceCmd, *RebalanceBetweenCmd, *AutoBalanceCmd, *ProbeCmd,
+		*TuiCmd, *ServeCmd:
+		return rebalancePermissions
+	case *RecommendCmd:
+		if cmd.DoIt {
+			return rebalancePermissions
+		}
+		return readOnlyPermissions
+	default:
+		return readOnlyPermissions
+	}
+}
+
+// permissionsMacaroonPath returns the configured macaroon file for
+// the permissions, falling back to macaroonpath.
+func permissionsMacaroonPath(perms []permission) string {
+	readOnly := map[permission]bool{}
+	for _, perm := range readOnlyPermissions {
+		readOnly[perm] = true
+	}
+	writes := false
+	for _, perm := range perms {
+		if !readOnly[perm] {
+			writes = true
+		}
+	}
+
+	if writes && gCfg.RebalanceMacaroonPath != "" {
+		return gCfg.RebalanceMacaroonPath
+	}
+	if !writes && gCfg.ReadOnlyMacaroonPath != "" {
+		return gCfg.ReadOnlyMacaroonPath
+	}
+	return gCfg.MacaroonPath
+}
+
+// lnd macaroons are baked by macaroon-bakery, whose identifiers are a
+// version byte followed by this protobuf message.
+type macaroonOp struct {
+	Entity  string   `protobuf:"bytes,1,opt,name=entity,proto3"`
+	Actions []string `protobuf:"bytes,2,rep,name=actions,proto3"`
+}
+
+func (op *macaroonOp) Reset()         { *op = macaroonOp{} }
+func (op *macaroonOp) String() string { return proto.CompactTextString(op) }
+func (*macaroonOp) ProtoMessage()     {}
+
+type macaroonId struct {
+	Nonce     []byte        `protobuf:"bytes,1,opt,name=nonce,proto3"`
+	StorageId []byte        `protobuf:"bytes,2,opt,name=storageId,proto3"`
+	Ops       []*macaroonOp `protobuf:"bytes,3,rep,name=ops,proto3"`
+}
+
+func (id *macaroonId) Reset()         { *id = macaroonId{} }
+func (id *macaroonId) String() string { return proto.CompactTextString(id) }
+func (*macaroonId) ProtoMessage()     {}
+
+const bakeryIdVersion = 3
+
+// macaroonPermissions returns the permissions the macaroon grants, or
+// false if its identifier isn't one lnd bakes or it grants RPCs by URI,
+// which we don't map our commands to.
+func macaroonPermissions(mac *macaroon.Macaroon) (map[permission]bool, bool) {
+	id := mac.Id()
+	if len(id) < 2 || id[0] != bakeryIdVersion {
+		return nil, false
+	}
+	decoded := &macaroonId{}
+	if err := proto.Unmarshal(id[1:], decoded); err != nil {
+		return nil, false
+	}
+
+	perms := map[permission]bool{}
+	for _, op := range decoded.Ops {
+		if op.Entity == "uri" {
+			return nil, false
+		}
+		for _, action := range op.Actions {
+			perms[permission{op.Entity, action}] = true
+		}
+	}
+	return perms, true
+}
+
+// checkPermissions returns an error naming the permissions the
+// macaroon lacks.  Macaroons which can't be decoded or which grant
+// URIs are left to lnd.
+func checkPermissions(mac *macaroon.Macaroon, needed []permission) error {
+	granted, ok := macaroonPermissions(mac)
+	if !ok {
+		if gCfg.Verbose {
+			fmt.Println("can't check the macaroon's permissions, leaving it to lnd")
+		}
+		return nil
+	}
+
+	missing := []string{}
+	for _, perm := range needed {
+		if !granted[perm] {
+			missing = append(missing, perm.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"the macaroon lacks the %s permissions this command needs, "+
+				"see lndtool bake-macaroon",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// bakeMacaroon asks lnd for a macaroon with just the permissions of the
+// level and prints it in hex or writes it to the output file.
+func bakeMacaroon(level, output string) error {
+	perms := readOnlyPermissions
+	if level == "rebalance" {
+		perms = rebalancePermissions
+	}
+
+	req := &lnrpc.BakeMacaroonRequest{}
+	for _, perm := range perms {
+		req.Permissions = append(req.Permissions, &lnrpc.MacaroonPermission{
+			Entity: perm.Entity,
+			Action: perm.Action,
+		})
+	}
+	rsp, err := gClient.BakeMacaroon(gCtx, req)
+	if err != nil {
+		panic(fmt.Sprint("BakeMacaroon failed:", err))
+	}
+
+	if output == "" {
+		fmt.Println(rsp.Macaroon)
+		return nil
+	}
+	data, err := hex.DecodeString(rsp.Macaroon)
+	if err != nil {
+		return fmt.Errorf("bad macaroon from lnd: %v", err)
+	}
+	output = cleanAndExpandPath(output)
+	if err := ioutil.WriteFile(output, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s macaroon to %s\n", level, output)
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// A LoopPrice is the cheapest circular route found for moving an amount
+// from the source channel to the destination channel.  FeeMsat is -1
+// if there was no route.
+type LoopPrice struct {
+	Tstamp  int64
+	SrcChan uint64
+	DstChan uint64
+	Amount  int64
+	FeeMsat int64
+	NumHops int
+}
+
+func (price *LoopPrice) PPM() int64 {
+	return price.FeeMsat * 1000 / price.Amount
+}
+
+// loopPrice returns the cached price if it is fresh, otherwise it
+// queries a route and caches the result.
+func loopPrice(info *lnrpc.GetInfoResponse, srcChan, dstChan uint64, amt int64, refresh bool) *LoopPrice {
+	if !refresh {
+		price := selectLoopPrice(srcChan, dstChan, amt)
+		if price != nil &&
+			time.Since(time.Unix(price.Tstamp, 0)) < gCfg.Pricing.MaxAge {
+			return price
+		}
+	}
+
+	price := &LoopPrice{
+		Tstamp:  time.Now().Unix(),
+		SrcChan: srcChan,
+		DstChan: dstChan,
+		Amount:  amt,
+		FeeMsat: -1,
+	}
+	// Allow any fee, we want to know the going rate.
+	route, err := loopRoute(info, amt, srcChan, dstChan, amt, nil)
+	if err == nil {
+		price.FeeMsat = route.TotalFeesMsat
+		price.NumHops = len(route.Hops)
+	}
+	upsertLoopPrice(price)
+	return price
+}
+
+// pricing prints the cost of rebalancing each candidate pair at each
+// amount next to the fee rate we charge on the destination channel,
+// which is what the moved liquidity can earn.
+func pricing(amountsStr string, refresh bool) error {
+	amounts, err := parseAmounts(amountsStr)
+	if err != nil {
+		return err
+	}
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		panic(fmt.Sprint("GetInfo failed:", err))
+	}
+
+	loops, err := candidateLoops(recommendChannels())
+	if err != nil {
+		return err
+	}
+	if len(loops) == 0 {
+		fmt.Println("no loops recommended")
+		return nil
+	}
+
+	idWidth := chanIdWidth()
+	hdr := fmt.Sprintf("%*s %*s %6s", idWidth, "SrcChan", idWidth, "DstChan", "OurPPM")
+	for _, amt := range amounts {
+		hdr += fmt.Sprintf(" %8d", amt)
+	}
+	color.Bold.Printf("%s Src -> Dst\n", hdr)
+
+	for _, loop := range loops {
+		ourPPM := int64(0)
+		if policy := hopPolicy(loop.DstChan, loop.DstNode); policy != nil {
+			ourPPM = policy.FeeRateMilliMsat
+		}
+
+		str := fmt.Sprintf("%*s %*s %6d",
+			idWidth, fmtChanId(loop.SrcChan), idWidth, fmtChanId(loop.DstChan), ourPPM)
+		cheapest := int64(-1)
+		for _, amt := range amounts {
+			price := loopPrice(info, loop.SrcChan, loop.DstChan, amt, refresh)
+			if price.FeeMsat < 0 {
+				str += fmt.Sprintf(" %8s", "-")
+				continue
+			}
+			str += fmt.Sprintf(" %8d", price.PPM())
+			if cheapest < 0 || price.PPM() < cheapest {
+				cheapest = price.PPM()
+			}
+		}
+		str += fmt.Sprintf(" %s -> %s",
+			probeAlias(loop.SrcNode), probeAlias(loop.DstNode))
+
+		// Rebalancing costs more than the channel earns back.
+		if cheapest < 0 || cheapest > ourPPM {
+			color.Yellow.Println(str)
+		} else {
+			color.Black.Println(str)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+)
+
+// EdgeLiquidity bounds the liquidity available to send over one
+// direction of a channel: MinSat has been seen to pass and MaxSat has
+// been seen to fail (or is the capacity).
+type EdgeLiquidity struct {
+	ChanId   uint64
+	Reverse  bool // sent from Node2 to Node1
+	FromNode string
+	ToNode   string
+	Tstamp   int64
+	MinSat   int64
+	MaxSat   int64
+}
+
+func (liq *EdgeLiquidity) passed(amt int64) {
+	if amt > liq.MinSat {
+		liq.MinSat = amt
+	}
+	if liq.MaxSat <= liq.MinSat {
+		// The liquidity moved since the failure.
+		liq.MaxSat = liq.MinSat + 1
+	}
+}
+
+func (liq *EdgeLiquidity) failed(amt int64) {
+	if amt < liq.MaxSat {
+		liq.MaxSat = amt
+	}
+	if liq.MinSat >= liq.MaxSat {
+		liq.MinSat = 0
+	}
+}
+
+type edgeKey struct {
+	chanId  uint64
+	reverse bool
+}
+
+type liquidityBounds map[edgeKey]*EdgeLiquidity
+
+func (bounds liquidityBounds) edge(chanId uint64, from, to string) *EdgeLiquidity {
+	chanInfo, err := getChanInfo(chanId)
+	if err != nil {
+		panic(fmt.Sprint("GetChanInfo failed:", err))
+	}
+	key := edgeKey{chanId, chanInfo.Node2Pub == from}
+	liq := bounds[key]
+	if liq == nil {
+		liq = &EdgeLiquidity{
+			ChanId:   chanId,
+			Reverse:  key.reverse,
+			FromNode: from,
+			ToNode:   to,
+			MaxSat:   chanInfo.Capacity,
+		}
+		bounds[key] = liq
+	}
+	return liq
+}
+
+// hopEdge returns the bounds of the channel used by the hop.
+func (bounds liquidityBounds) hopEdge(ourPubKey string, route *lnrpc.Route, ndx int) *EdgeLiquidity {
+	from := ourPubKey
+	if ndx > 0 {
+		from = route.Hops[ndx-1].PubKey
+	}
+	hop := route.Hops[ndx]
+	return bounds.edge(hop.ChanId, from, hop.PubKey)
+}
+
+// recentLiquidity returns the stored liquidity bounds which are newer
+// than --probe.maxage.
+func recentLiquidity() liquidityBounds {
+	since := time.Now().Add(-gCfg.Probe.MaxAge).Unix()
+	bounds := liquidityBounds{}
+	for _, liq := range selectEdgeLiquidity(since, "") {
+		bounds[edgeKey{liq.ChanId, liq.Reverse}] = liq
+	}
+	return bounds
+}
+
+// recordRouteFailure stores what a failed payment says about the
+// liquidity of the route: the hops before the node reporting the
+// failure carried their amounts, and a temporary channel failure means
+// the next hop couldn't.
+func recordRouteFailure(ourPubKey string, route *lnrpc.Route, failure *lnrpc.Failure) {
+	bounds := recentLiquidity()
+	learned := []*EdgeLiquidity{}
+	errNdx := int(failure.GetFailureSourceIndex())
+	for ndx := 0; ndx < errNdx && ndx < len(route.Hops); ndx++ {
+		liq := bounds.hopEdge(ourPubKey, route, ndx)
+		liq.passed(hopAmount(route.Hops[ndx]))
+		learned = append(learned, liq)
+	}
+	if failure.Code == lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE && errNdx < len(route.Hops) {
+		liq := bounds.hopEdge(ourPubKey, route, errNdx)
+		liq.failed(hopAmount(route.Hops[errNdx]))
+		learned = append(learned, liq)
+	}
+
+	now := time.Now().Unix()
+	for _, liq := range learned {
+		liq.Tstamp = now
+		upsertEdgeLiquidity(liq)
+	}
+}
+
+// hopAmount returns the amount sent over the hop's channel.
+func hopAmount(hop *lnrpc.Hop) int64 {
+	return (hop.AmtToForwardMsat + hop.FeeMsat) / 1000
+}
+
+// sendProbe sends amt along the route with a payment hash the
+// destination can't know.  It returns the index of the hop which lacked
+// the liquidity, or -1 if the payment reached the destination.
+func sendProbe(info *lnrpc.GetInfoResponse, route *lnrpc.Route, amt int64, bounds liquidityBounds) (int, error) {
+	repriceRoute(info, route, amt)
+
+	hash := make([]byte, 32)
+	_, err := rand.Read(hash)
+	if err != nil {
+		panic(fmt.Sprint("unable to generate payment hash:", err))
+	}
+
+	ctxt, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	rsp, err := gRouter.SendToRoute(ctxt, &routerrpc.SendToRouteRequest{
+		PaymentHash: hash,
+		Route:       route,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("router.SendToRoute failed: %v", err)
+	}
+	if rsp.Failure == nil {
+		// Somebody knew the preimage, it made it anyway.
+		return -1, nil
+	}
+
+	// Every hop before the node reporting the failure forwarded it.
+	errNdx := int(rsp.Failure.GetFailureSourceIndex())
+	for ndx := 0; ndx < errNdx && ndx < len(route.Hops); ndx++ {
+		bounds.hopEdge(info.IdentityPubkey, route, ndx).
+			passed(hopAmount(route.Hops[ndx]))
+	}
+
+	switch rsp.Failure.Code {
+	case lnrpc.Failure_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS:
+		if errNdx == len(route.Hops) {
+			return -1, nil
+		}
+	case lnrpc.Failure_TEMPORARY_CHANNEL_FAILURE:
+		if errNdx < len(route.Hops) {
+			bounds.hopEdge(info.IdentityPubkey, route, errNdx).
+				failed(hopAmount(route.Hops[errNdx]))
+			return errNdx, nil
+		}
+	}
+	return 0, fmt.Errorf("%s at hop %d", rsp.Failure.Code.String(), errNdx)
+}
+
+// probeRoute binary searches the largest amount which reaches the end
+// of the route.  Each attempt bounds the liquidity of the hops it got
+// through and of the hop which failed, so hops past the bottleneck only
+// get lower bounds.
+func probeRoute(info *lnrpc.GetInfoResponse, route *lnrpc.Route, maxAmt int64, bounds liquidityBounds) {
+	lo, hi := int64(0), maxAmt+1
+	amt := maxAmt
+	for amt > 0 {
+		errNdx, err := sendProbe(info, route, amt, bounds)
+		if err != nil {
+			color.Red.Printf("%10d: %v\n", amt, err)
+			return
+		}
+		if errNdx < 0 {
+			fmt.Printf("%10d: reached destination\n", amt)
+			lo = amt
+		} else {
+			from := info.IdentityPubkey
+			if errNdx > 0 {
+				from = route.Hops[errNdx-1].PubKey
+			}
+			fmt.Printf("%10d: %s -> %s lacks liquidity\n",
+				amt, probeAlias(from), probeAlias(route.Hops[errNdx].PubKey))
+			hi = amt
+		}
+		if hi-lo <= gCfg.Probe.Precision {
+			break
+		}
+		amt = (lo + hi) / 2
+	}
+	fmt.Printf("can send %d\n", lo)
+}
+
+func probeAlias(pubkey string) string {
+	nodeInfo, err := getNodeInfo(pubkey)
+	if err != nil {
+		return abbrevPubKey(pubkey)
+	}
+	return nodeInfo.Alias
+}
+
+// routeMaxAmount returns the largest amount worth probing on the route,
+// limited by our local balance and the smallest channel.
+func routeMaxAmount(route *lnrpc.Route, localBalance map[uint64]int64, maxAmt int64) int64 {
+	limit := localBalance[route.Hops[0].ChanId]
+	for _, hop := range route.Hops[1:] {
+		if hop.ChanCapacity < limit {
+			limit = hop.ChanCapacity
+		}
+	}
+	if maxAmt > 0 && maxAmt < limit {
+		limit = maxAmt
+	}
+	return limit
+}
+
+// peerRoutes returns a two hop route through our best funded channel to
+// the peer over each of the peer's other channels.
+func peerRoutes(ourPubKey, peer string, channels []*lnrpc.Channel) ([]*lnrpc.Route, error) {
+	var ours *lnrpc.Channel
+	for _, chn := range channels {
+		if chn.RemotePubkey == peer &&
+			(ours == nil || chn.LocalBalance > ours.LocalBalance) {
+			ours = chn
+		}
+	}
+	if ours == nil {
+		return nil, fmt.Errorf("no active channel to %s", peer)
+	}
+
+	nodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
+		PubKey:          peer,
+		IncludeChannels: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []*lnrpc.Route{}
+	for _, edge := range nodeInfo.Channels {
+		far, policy := edge.Node2Pub, edge.Node1Policy
+		if edge.Node2Pub == peer {
+			far, policy = edge.Node1Pub, edge.Node2Policy
+		}
+		if far == ourPubKey || policy == nil || policy.Disabled {
+			continue
+		}
+		routes = append(routes, &lnrpc.Route{
+			Hops: []*lnrpc.Hop{
+				{
+					ChanId:       ours.ChanId,
+					ChanCapacity: ours.Capacity,
+					PubKey:       peer,
+				},
+				{
+					ChanId:       edge.ChannelId,
+					ChanCapacity: edge.Capacity,
+					PubKey:       far,
+				},
+			},
+		})
+	}
+	return routes, nil
+}
+
+func probe(dests, peers []string, maxAmt int64) error {
+	if len(dests) == 0 && len(peers) == 0 {
+		return fmt.Errorf("probe needs at least one --dest or --peer")
+	}
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		panic(fmt.Sprint("GetInfo failed:", err))
+	}
+
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
+		ActiveOnly: true,
+	})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+	localBalance := map[uint64]int64{}
+	for _, chn := range rsp.Channels {
+		localBalance[chn.ChanId] = chn.LocalBalance
+	}
+
+	bounds := liquidityBounds{}
+
+	for _, dest := range dests {
+		color.Bold.Printf("probing route to %s\n", probeAlias(dest))
+		qrsp, err := gClient.QueryRoutes(gCtx, &lnrpc.QueryRoutesRequest{
+			PubKey:         dest,
+			Amt:            gCfg.Probe.Precision,
+			FinalCltvDelta: int32(gCfg.Rebalance.FinalCLTVDelta),
+		})
+		if err != nil || len(qrsp.Routes) == 0 {
+			color.Red.Println("no routes found")
+			continue
+		}
+		route := qrsp.Routes[0]
+		probeRoute(info, route, routeMaxAmount(route, localBalance, maxAmt), bounds)
+	}
+
+	for _, name := range peers {
+		peer, err := resolvePeer(name, rsp.Channels)
+		if err != nil {
+			return err
+		}
+		routes, err := peerRoutes(info.IdentityPubkey, peer, rsp.Channels)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			color.Bold.Printf("probing %s %s -> %s\n", fmtChanId(route.Hops[1].ChanId),
+				probeAlias(peer), probeAlias(route.Hops[1].PubKey))
+			probeRoute(info, route, routeMaxAmount(route, localBalance, maxAmt), bounds)
+		}
+	}
+
+	// Save and show what we learned.
+	all := []*EdgeLiquidity{}
+	now := time.Now().Unix()
+	for _, liq := range bounds {
+		liq.Tstamp = now
+		upsertEdgeLiquidity(liq)
+		all = append(all, liq)
+	}
+	sort.Slice(all, func(ii, jj int) bool {
+		return all[ii].ChanId < all[jj].ChanId
+	})
+
+	fmt.Println()
+	idWidth := chanIdWidth()
+	color.Bold.Printf("%*s     MinSat     MaxSat From -> To\n", idWidth, "ChanId")
+	for _, liq := range all {
+		fmt.Printf("%*s %10d %10d %s -> %s\n",
+			idWidth, fmtChanId(liq.ChanId), liq.MinSat, liq.MaxSat,
+			probeAlias(liq.FromNode), probeAlias(liq.ToNode))
+	}
+	return nil
+}
+
+// lackingLiquidity returns the edges recently probed to be unable to
+// carry amt.
+func lackingLiquidity(amt int64) []*lnrpc.EdgeLocator {
+	since := time.Now().Add(-gCfg.Probe.MaxAge).Unix()
+	edges := []*lnrpc.EdgeLocator{}
+	for _, liq := range selectEdgeLiquidity(since, "") {
+		if liq.MaxSat <= amt {
+			edges = append(edges, &lnrpc.EdgeLocator{
+				ChannelId:        liq.ChanId,
+				DirectionReverse: liq.Reverse,
+			})
+		}
+	}
+	return edges
+}
+
+// outboundLiquidity returns the most the node was recently probed to be
+// able to forward in one payment.  It is only known if every one of the
+// node's channels other than ours has been probed.
+func outboundLiquidity(node string, ourChans int) (int64, bool) {
+	since := time.Now().Add(-gCfg.Probe.MaxAge).Unix()
+	// Failed loops also bound the node's channels back to us, which
+	// aren't counted.
+	probed := []*EdgeLiquidity{}
+	for _, liq := range selectEdgeLiquidity(since, node) {
+		if liq.ToNode != gNode && !gOurNodes[liq.ToNode] {
+			probed = append(probed, liq)
+		}
+	}
+	if len(probed) == 0 {
+		return 0, false
+	}
+	nodeInfo, err := getNodeInfo(node)
+	if err != nil {
+		return 0, false
+	}
+	if len(probed) < int(nodeInfo.NumChannels)-ourChans {
+		return 0, false
+	}
+	best := int64(0)
+	for _, liq := range probed {
+		if liq.MinSat > best {
+			best = liq.MinSat
+		}
+	}
+	return best, true
+}
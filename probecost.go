@@ -0,0 +1,215 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+type ProbeCost struct {
+	Amount    int64  `json:"amount"`
+	Source    string `json:"source"` // "queryroutes", "graph" or "none"
+	FeeMsat   int64  `json:"fee_msat"`
+	FeePPM    int64  `json:"fee_ppm"`
+	NumHops   int    `json:"num_hops"`
+	TotalCLTV uint32 `json:"total_cltv"`
+	FirstHop  uint64 `json:"first_hop_chan_id"`
+	FirstPeer string `json:"first_hop_pubkey"`
+	Error     string `json:"error,omitempty"`
+}
+
+// parseAmount parses a satoshi amount with an optional k or M suffix.
+func parseAmount(str string) (int64, error) {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(str, "k"):
+		mult = 1e3
+		str = strings.TrimSuffix(str, "k")
+	case strings.HasSuffix(str, "M"):
+		mult = 1e6
+		str = strings.TrimSuffix(str, "M")
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val <= 0 {
+		return 0, fmt.Errorf("bad amount %q", str)
+	}
+	return int64(val * mult), nil
+}
+
+func parseAmounts(str string) ([]int64, error) {
+	amounts := []int64{}
+	for _, field := range strings.Split(str, ",") {
+		amt, err := parseAmount(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		amounts = append(amounts, amt)
+	}
+	return amounts, nil
+}
+
+func queryRouteCost(dest string, amt int64, height uint32) (*ProbeCost, error) {
+	rsp, err := gClient.QueryRoutes(gCtx, &lnrpc.QueryRoutesRequest{
+		PubKey:         dest,
+		Amt:            amt,
+		FinalCltvDelta: int32(gCfg.Rebalance.FinalCLTVDelta),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Routes) == 0 {
+		return nil, fmt.Errorf("no routes")
+	}
+	route := rsp.Routes[0]
+	return &ProbeCost{
+		Amount:    amt,
+		Source:    "queryroutes",
+		FeeMsat:   route.TotalFeesMsat,
+		FeePPM:    route.TotalFeesMsat * 1000 / amt,
+		NumHops:   len(route.Hops),
+		TotalCLTV: route.TotalTimeLock - height,
+		FirstHop:  route.Hops[0].ChanId,
+		FirstPeer: route.Hops[0].PubKey,
+	}, nil
+}
+
+// graphRouteCost prices the farside path to the destination at the
+// amount.  The path is the cheapest for the farside transfer size, so
+// this is an estimate.
+func graphRouteCost(path []*PathHop, amt int64) (*ProbeCost, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("not reachable in the graph")
+	}
+
+	// Work backwards from the destination, we don't pay the fee on
+	// our own first hop.
+	amtMsat := amt * 1000
+	feeMsat := int64(0)
+	cltv := gCfg.Rebalance.FinalCLTVDelta
+	for ndx := len(path) - 1; ndx >= 0; ndx-- {
+		hop := path[ndx]
+		if amtMsat+feeMsat > hop.Edge.Capacity*1000 {
+			return nil, fmt.Errorf("channel %d too small", hop.Edge.ChannelId)
+		}
+		if ndx == 0 {
+			break
+		}
+		policy := hop.Policy
+		fwdMsat := amtMsat + feeMsat
+		feeMsat += policy.FeeBaseMsat +
+			(fwdMsat*policy.FeeRateMilliMsat)/1000000
+		cltv += policy.TimeLockDelta
+	}
+
+	return &ProbeCost{
+		Amount:    amt,
+		Source:    "graph",
+		FeeMsat:   feeMsat,
+		FeePPM:    feeMsat * 1000 / amt,
+		NumHops:   len(path),
+		TotalCLTV: cltv,
+		FirstHop:  path[0].Edge.ChannelId,
+		FirstPeer: path[0].To.PubKey,
+	}, nil
+}
+
+func probeCosts(dest string, amounts []int64) []*ProbeCost {
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		panic(fmt.Sprintf("GetInfo failed: %v", err))
+	}
+
+	// Only load the graph if QueryRoutes fails.
+	var path []*PathHop
+	var graphErr error
+	graphLoaded := false
+
+	costs := []*ProbeCost{}
+	for _, amt := range amounts {
+		cost, err := queryRouteCost(dest, amt, info.BlockHeight)
+		if err == nil {
+			costs = append(costs, cost)
+			continue
+		}
+		qrErr := err
+
+		if !graphLoaded {
+			graphLoaded = true
+			var graph *Graph
+			graph, graphErr = loadGraph()
+			if graphErr == nil && graph.OurNode == nil {
+				graphErr = fmt.Errorf("our node is not in the graph")
+			}
+			if graphErr == nil {
+				graph.OurNode.Propagate(0, 0, graph.Cost)
+				if node := graph.Nodes[dest]; node != nil {
+					path = node.PathTo()
+				}
+			}
+		}
+		if graphErr == nil {
+			cost, err = graphRouteCost(path, amt)
+			if err == nil {
+				costs = append(costs, cost)
+				continue
+			}
+		} else {
+			err = graphErr
+		}
+
+		costs = append(costs, &ProbeCost{
+			Amount: amt,
+			Source: "none",
+			Error:  fmt.Sprintf("queryroutes: %v; graph: %v", qrErr, err),
+		})
+	}
+	return costs
+}
+
+func probeCost(dest string, amountsStr string, asJSON bool) error {
+	amounts, err := parseAmounts(amountsStr)
+	if err != nil {
+		return err
+	}
+
+	costs := probeCosts(dest, amounts)
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(costs)
+	}
+
+	idWidth := chanIdWidth()
+	color.Bold.Printf("   Amount Source         FeeMsat    PPM Hops CLTV %*s Alias\n",
+		idWidth, "ChanId")
+	for _, cost := range costs {
+		if cost.Error != "" {
+			color.Red.Printf("%9d %-11s %s\n", cost.Amount, cost.Source, cost.Error)
+			continue
+		}
+		alias := ""
+		nodeInfo, err := getNodeInfo(cost.FirstPeer)
+		if err == nil {
+			alias = nodeInfo.Alias
+		}
+		fmt.Printf("%9d %-11s %10d %6d %4d %4d %*s %s\n",
+			cost.Amount,
+			cost.Source,
+			cost.FeeMsat,
+			cost.FeePPM,
+			cost.NumHops,
+			cost.TotalCLTV,
+			idWidth, fmtChanId(cost.FirstHop),
+			alias,
+		)
+	}
+	return nil
+}
@@ -17,8 +17,7 @@ import (
 var ignoreBadEdges = true // Ignore bad edges on subsequent QueryRoutes
 
 func hopPolicy(chanId uint64, dstNode string) *lnrpc.RoutingPolicy {
-	chanInfo, err :=
-		gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{ChanId: chanId})
+	chanInfo, err := getChanInfo(chanId)
 	if err != nil {
 		panic(fmt.Sprintf("last GetChanInfo failed:", err))
 	}
@@ -31,10 +30,12 @@ func hopPolicy(chanId uint64, dstNode string) *lnrpc.RoutingPolicy {
 
 func dumpRoute(info *lnrpc.GetInfoResponse, route *lnrpc.Route) {
 
-	fmt.Println("ChanId               Capacity     Amt    AmtMsat  Fee  FeeMsat Dlt PubKey                                                                   FB   FR  Dlt Alias")
+	idWidth := chanIdWidth()
+	fmt.Printf("%-*s   Capacity     Amt    AmtMsat  Fee  FeeMsat Dlt PubKey                                                                   FB   FR  Dlt Alias\n",
+		idWidth, "ChanId")
 
-	fmt.Printf("%29s %7d %10d %12s %4d %s %18s %s\n",
-		"",
+	fmt.Printf("%*s %7d %10d %12s %4d %s %18s %s\n",
+		idWidth+11, "",
 		route.TotalAmt,
 		route.TotalAmtMsat,
 		"",
@@ -52,13 +53,11 @@ func dumpRoute(info *lnrpc.GetInfoResponse, route *lnrpc.Route) {
 	}
 
 	for ndx, hop := range route.Hops {
-		nodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
-			PubKey: hop.PubKey,
-		})
+		nodeInfo, err := getNodeInfo(hop.PubKey)
 		if err != nil {
 			panic(fmt.Sprintf("GetNodeInfo failed[1]:", err))
 		}
-		alias := nodeInfo.Node.Alias
+		alias := nodeInfo.Alias
 
 		// The policy information comes from the next hop.
 		pstr := ""
@@ -76,8 +75,8 @@ func dumpRoute(info *lnrpc.GetInfoResponse, route *lnrpc.Route) {
 			)
 		}
 
-		fmt.Printf("%d %10d %7d %10d %4d %7d %4d %s %18s %s\n",
-			hop.ChanId,
+		fmt.Printf("%-*s %10d %7d %10d %4d %7d %4d %s %18s %s\n",
+			idWidth, fmtChanId(hop.ChanId),
 			hop.ChanCapacity,
 			hop.AmtToForward,
 			hop.AmtToForwardMsat,
@@ -91,8 +90,8 @@ func dumpRoute(info *lnrpc.GetInfoResponse, route *lnrpc.Route) {
 	}
 
 	// Print fee totals.
-	fmt.Printf("%48s %4d %7d\n",
-		"",
+	fmt.Printf("%*s %4d %7d\n",
+		idWidth+30, "",
 		route.TotalFees,
 		route.TotalFeesMsat,
 	)
@@ -202,10 +201,96 @@ func rebalance(args []string) {
 	}
 	dstChanId := uint64(dstChanIdI)
 
-	doRebalance(amt, srcChanId, dstChanId)
+	doRebalance(amt, srcChanId, dstChanId, chanFeeLimitRate(amt, dstChanId))
+}
+
+// loopRoute finds the cheapest route for amt from us out through the
+// source channel and back in through the destination channel.
+func loopRoute(
+	info *lnrpc.GetInfoResponse,
+	amt int64,
+	srcChanId, dstChanId uint64,
+	feeLimitFixed int64,
+	ignoredEdges []*lnrpc.EdgeLocator,
+) (*lnrpc.Route, error) {
+	ourPubKey := info.IdentityPubkey
+
+	srcChanInfo, err := getChanInfo(srcChanId)
+	if err != nil {
+		panic(fmt.Sprintf("src GetChanInfo failed:", err))
+	}
+	srcPubKey := srcChanInfo.Node1Pub
+	if srcPubKey == ourPubKey {
+		srcPubKey = srcChanInfo.Node2Pub
+	}
+
+	dstChanInfo, err := getChanInfo(dstChanId)
+	if err != nil {
+		panic(fmt.Sprintf("dst GetChanInfo failed:", err))
+	}
+	dstPubKey := dstChanInfo.Node1Pub
+	if dstPubKey == ourPubKey {
+		dstPubKey = dstChanInfo.Node2Pub
+	}
+
+	ourNode, err := hex.DecodeString(ourPubKey)
+	if err != nil {
+		panic(fmt.Sprintf("hex.DecodeString failed:", err))
+	}
+
+	rsp, err := gClient.QueryRoutes(gCtx, &lnrpc.QueryRoutesRequest{
+		PubKey: dstPubKey,
+		Amt:    amt,
+		FeeLimit: &lnrpc.FeeLimit{
+			Limit: &lnrpc.FeeLimit_Fixed{
+				Fixed: feeLimitFixed,
+			},
+		},
+		SourcePubKey:   srcPubKey,
+		FinalCltvDelta: int32(gCfg.Rebalance.FinalCLTVDelta),
+		IgnoredEdges:   ignoredEdges,
+		IgnoredNodes:   [][]byte{ourNode},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only get one route, only consider the first slot.
+	route := rsp.Routes[0]
+
+	// Prepend the initial hop from us through the src channel
+	hop0 := &lnrpc.Hop{
+		ChanId:       srcChanId,
+		ChanCapacity: srcChanInfo.Capacity,
+		AmtToForward: amt,
+		PubKey:       srcPubKey,
+		// We will set all of these when we "reprice" the route.
+		// Fee:
+		// Expiry:
+		// AmtToForwardMsat:
+		// FeeMSat:
+	}
+	route.Hops = append([]*lnrpc.Hop{hop0}, route.Hops...)
+
+	// Append the final hop back to us through the dst channel
+	hopN := &lnrpc.Hop{
+		ChanId:       dstChanId,
+		ChanCapacity: dstChanInfo.Capacity,
+		AmtToForward: amt,
+		PubKey:       ourPubKey,
+		// We will set all of these when we "reprice" the route.
+		// Fee:
+		// Expiry:
+		// AmtToForwardMsat:
+		// FeeMSat:
+	}
+	route.Hops = append(route.Hops, hopN)
+
+	repriceRoute(info, route, amt)
+	return route, nil
 }
 
-func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
+func doRebalance(amt int64, srcChanId, dstChanId uint64, feeLimitRate float64) bool {
 
 	// What is our own PubKey?
 	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
@@ -215,9 +300,7 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 	ourPubKey := info.IdentityPubkey
 
 	// What is the src pub key?
-	srcChanInfo, err := gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{
-		ChanId: srcChanId,
-	})
+	srcChanInfo, err := getChanInfo(srcChanId)
 	if err != nil {
 		panic(fmt.Sprintf("src GetChanInfo failed:", err))
 	}
@@ -227,17 +310,13 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 	} else {
 		srcPubKey = srcChanInfo.Node1Pub
 	}
-	srcNodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
-		PubKey: srcPubKey,
-	})
+	srcNodeInfo, err := getNodeInfo(srcPubKey)
 	if err != nil {
 		panic(fmt.Sprint("src GetNodeInfo failed:", err))
 	}
 
 	// What is the dst pub key?
-	dstChanInfo, err := gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{
-		ChanId: dstChanId,
-	})
+	dstChanInfo, err := getChanInfo(dstChanId)
 	if err != nil {
 		panic(fmt.Sprintf("dst GetChanInfo failed:", err))
 	}
@@ -247,27 +326,23 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 	} else {
 		dstPubKey = dstChanInfo.Node1Pub
 	}
-	dstNodeInfo, err := gClient.GetNodeInfo(gCtx, &lnrpc.NodeInfoRequest{
-		PubKey: dstPubKey,
-	})
+	dstNodeInfo, err := getNodeInfo(dstPubKey)
 	if err != nil {
 		panic(fmt.Sprint("dst GetNodeInfo failed:", err))
 	}
 
-	feeLimitPercent := gCfg.Rebalance.FeeLimitRate * 100
+	feeLimitPercent := feeLimitRate * 100
 	feeLimitFixed := int64(float64(amt) * (feeLimitPercent / 100))
 	if gCfg.Verbose {
 		fmt.Printf("limit fee rate to %f, %d sat\n",
-			gCfg.Rebalance.FeeLimitRate, feeLimitFixed)
+			feeLimitRate, feeLimitFixed)
 	}
 
 	// Defer creating invoice until we get far enough to need one.
 	var invoiceRsp *lnrpc.AddInvoiceResponse = nil
 
-	ourNode, err := hex.DecodeString(ourPubKey)
-	if err != nil {
-		panic(fmt.Sprintf("hex.DecodeString failed:", err))
-	}
+	// Edges which probing found can't carry this amount.
+	probedEdges := lackingLiquidity(amt)
 
 	for {
 	RetryQuery:
@@ -279,19 +354,20 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 					badEdges = append(badEdges, edge)
 				}
 			}
+			badEdges = append(badEdges, probedEdges...)
 		}
 
-		srcAlias := srcNodeInfo.Node.Alias
+		srcAlias := srcNodeInfo.Alias
 		if len(srcAlias) > 26 {
 			srcAlias = srcAlias[:26]
 		}
-		dstAlias := dstNodeInfo.Node.Alias
+		dstAlias := dstNodeInfo.Alias
 		if len(dstAlias) > 26 {
 			dstAlias = dstAlias[:26]
 		}
 
-		fmt.Printf("%d %26s -> %-26s %d %7d: ",
-			srcChanId, srcAlias, dstAlias, dstChanId, amt)
+		fmt.Printf("%s %26s -> %-26s %s %7d: ",
+			fmtChanId(srcChanId), srcAlias, dstAlias, fmtChanId(dstChanId), amt)
 
 		if gCfg.Verbose {
 			fmt.Println()
@@ -305,79 +381,37 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 		// Consider removing badEdges and trying use_mission_control
 		// instead ...
 
-		rsp, err := gClient.QueryRoutes(gCtx, &lnrpc.QueryRoutesRequest{
-			PubKey: dstPubKey,
-			Amt:    amt,
-			FeeLimit: &lnrpc.FeeLimit{
-				Limit: &lnrpc.FeeLimit_Fixed{
-					Fixed: feeLimitFixed,
-				},
-			},
-			SourcePubKey:   srcPubKey,
-			FinalCltvDelta: int32(gCfg.Rebalance.FinalCLTVDelta),
-			IgnoredEdges:   badEdges,
-			IgnoredNodes:   [][]byte{ourNode},
-		})
-
+		route, err := loopRoute(info, amt, srcChanId, dstChanId,
+			feeLimitFixed, badEdges)
 		if err != nil {
 			fmt.Println("no routes found at this fee limit")
 			insertLoopAttempt(NewLoopAttempt(
 				time.Now().Unix(),
 				srcChanId, srcPubKey,
 				dstChanId, dstPubKey,
-				amt, gCfg.Rebalance.FeeLimitRate,
-				LoopAttemptNoRoutes,
+				amt, feeLimitRate,
+				LoopAttemptNoRoutes, 0,
 			))
 			return false
 		}
 
-		// Only get one route, only consider the first slot.
-		route := rsp.Routes[0]
-
-		// Prepend the initial hop from us through the src channel
-		hop0 := &lnrpc.Hop{
-			ChanId:       srcChanId,
-			ChanCapacity: srcChanInfo.Capacity,
-			AmtToForward: amt,
-			PubKey:       srcPubKey,
-			// We will set all of these when we "reprice" the route.
-			// Fee:
-			// Expiry:
-			// AmtToForwardMsat:
-			// FeeMSat:
-		}
-		route.Hops = append([]*lnrpc.Hop{hop0}, route.Hops...)
-
-		// Append the final hop back to us through the dst channel
-		hopN := &lnrpc.Hop{
-			ChanId:       dstChanId,
-			ChanCapacity: dstChanInfo.Capacity,
-			AmtToForward: amt,
-			PubKey:       ourPubKey,
-			// We will set all of these when we "reprice" the route.
-			// Fee:
-			// Expiry:
-			// AmtToForwardMsat:
-			// FeeMSat:
-		}
-		route.Hops = append(route.Hops, hopN)
-
-		repriceRoute(info, route, amt)
-
 		if gCfg.Verbose {
 			dumpRoute(info, route)
 		}
 
 		checkRoute(info, route)
 
-		if (route.TotalFeesMsat / 1000) > feeLimitFixed {
+		// Fees paid to our own nodes come back to us.
+		internalFeeMsat := internalFeesMsat(route)
+
+		if ((route.TotalFeesMsat - internalFeeMsat) / 1000) > feeLimitFixed {
 			fmt.Println("route exceeds fee limit")
 			insertLoopAttempt(NewLoopAttempt(
 				time.Now().Unix(),
 				srcChanId, srcPubKey,
 				dstChanId, dstPubKey,
-				amt, gCfg.Rebalance.FeeLimitRate,
-				LoopAttemptNoRoutes,
+				amt, feeLimitRate,
+				LoopAttemptNoRoutes, 0,
 			))
 			return false
 		}
@@ -428,6 +462,7 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 			// the hopNdx == errNdx is the failed hop.
 			//
 			errNdx := sendRsp.Failure.GetFailureSourceIndex()
+			recordRouteFailure(gNode, route, sendRsp.Failure)
 
 			// If we are reporting the error let's bail on this
 			// route altogether since the first hop doesn't work.
@@ -447,24 +482,18 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 			// }
 
 			// Get info about the node reporting the error.
-			nodeInfo0, err := gClient.GetNodeInfo(gCtx,
-				&lnrpc.NodeInfoRequest{
-					PubKey: pubKey,
-				})
+			nodeInfo0, err := getNodeInfo(pubKey)
 			if err != nil {
 				panic(fmt.Sprintf("GetNodeInfo failed[1]:", err))
 			}
-			alias0 := nodeInfo0.Node.Alias
+			alias0 := nodeInfo0.Alias
 
 			// Get info about the target node of the failed hop.
-			nodeInfo1, err := gClient.GetNodeInfo(gCtx,
-				&lnrpc.NodeInfoRequest{
-					PubKey: route.Hops[errNdx].PubKey,
-				})
+			nodeInfo1, err := getNodeInfo(route.Hops[errNdx].PubKey)
 			if err != nil {
 				panic(fmt.Sprintf("GetNodeInfo2 failed[1]:", err))
 			}
-			alias1 := nodeInfo1.Node.Alias
+			alias1 := nodeInfo1.Alias
 
 			fmt.Printf("%s -> %s: %s\n",
 				alias0,
@@ -481,10 +510,16 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 
 			chanId := route.Hops[errNdx].ChanId
 
-			nextChanInfo, err :=
-				gClient.GetChanInfo(gCtx, &lnrpc.ChanInfoRequest{
-					ChanId: chanId,
-				})
+			// A fee or expiry complaint means our cached policy for
+			// this channel is stale.
+			switch sendRsp.Failure.Code {
+			case lnrpc.Failure_FEE_INSUFFICIENT,
+				lnrpc.Failure_INCORRECT_CLTV_EXPIRY,
+				lnrpc.Failure_EXPIRY_TOO_SOON:
+				invalidateChanInfo(chanId)
+			}
+
+			nextChanInfo, err := getChanInfo(chanId)
 			if err != nil {
 				panic(fmt.Sprintf("hop GetChanInfo failed:", err))
 			}
@@ -510,13 +545,19 @@ func doRebalance(amt int64, srcChanId, dstChanId uint64) bool {
 			goto RetryQuery
 		} else {
 			fmt.Printf("PREIMAGE: %s\n", hex.EncodeToString(sendRsp.Preimage))
-			insertLoopAttempt(NewLoopAttempt(
+			if len(gOurNodes) > 0 {
+				fmt.Printf("fees: %d msat internal, %d msat external\n",
+					internalFeeMsat, route.TotalFeesMsat-internalFeeMsat)
+			}
+			attempt := NewLoopAttempt(
 				time.Now().Unix(),
 				srcChanId, srcPubKey,
 				dstChanId, dstPubKey,
-				amt, gCfg.Rebalance.FeeLimitRate,
-				LoopAttemptSuccess,
-			))
+				amt, feeLimitRate,
+				LoopAttemptSuccess, route.TotalFeesMsat,
+			)
+			attempt.InternalFeeMsat = internalFeeMsat
+			insertLoopAttempt(attempt)
 			return true
 		}
 	}
@@ -526,8 +567,8 @@ FailedToRoute:
 		time.Now().Unix(),
 		srcChanId, srcPubKey,
 		dstChanId, dstPubKey,
-		amt, gCfg.Rebalance.FeeLimitRate,
-		LoopAttemptFailure,
+		amt, feeLimitRate,
+		LoopAttemptFailure, 0,
 	))
 	return false
 }
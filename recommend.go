@@ -39,21 +39,8 @@ func NewPotentialLoop(
 	}
 }
 
-func recommend(doit bool) bool {
-
-	var blacklist = map[string]bool{}
-	for _, node := range gCfg.Recommend.PeerNodeBlacklist {
-		blacklist[node] = true
-	}
-	var srclist = map[uint64]bool{}
-	for _, node := range gCfg.Recommend.SrcChanTarget {
-		srclist[node] = true
-	}
-	var dstlist = map[uint64]bool{}
-	for _, node := range gCfg.Recommend.DstChanTarget {
-		dstlist[node] = true
-	}
-
+// recommendChannels returns the channels considered for rebalancing.
+func recommendChannels() []*lnrpc.Channel {
 	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
 		ActiveOnly:   true,
 		InactiveOnly: false,
@@ -63,12 +50,33 @@ func recommend(doit bool) bool {
 	if err != nil {
 		panic(fmt.Sprint("ListChannels failed:", err))
 	}
+	return rsp.Channels
+}
+
+// candidateLoops returns the loops which would improve the balance of
+// both channels, largest first.
+func candidateLoops(channels []*lnrpc.Channel) ([]*PotentialLoop, error) {
+	// Names are resolved among all our peers, not just the ones with
+	// channels considered, so a blacklisted peer going offline isn't
+	// an error.
+	blacklist, err := peerSet(gCfg.Recommend.PeerNodeBlacklist, allChannels())
+	if err != nil {
+		return nil, fmt.Errorf("recommend.peernodeblacklist: %v", err)
+	}
+	srclist, err := chanIdSet(gCfg.Recommend.SrcChanTarget)
+	if err != nil {
+		return nil, fmt.Errorf("recommend.srcchantarget: %v", err)
+	}
+	dstlist, err := chanIdSet(gCfg.Recommend.DstChanTarget)
+	if err != nil {
+		return nil, fmt.Errorf("recommend.dstchantarget: %v", err)
+	}
 
 	// Aggregate local and remote balances per node (matters when
 	// there are multiple channels to the same node.
 	//
 	nodeBalances := map[string]*NodeBalance{}
-	for _, nodeChan := range rsp.Channels {
+	for _, nodeChan := range channels {
 		nb := nodeBalances[nodeChan.RemotePubkey]
 		if nb == nil {
 			nb = &NodeBalance{0, 0}
@@ -80,7 +88,7 @@ func recommend(doit bool) bool {
 
 	// Consider all combinations of channels
 	loops := []*PotentialLoop{}
-	for srcNdx, srcChan := range rsp.Channels {
+	for srcNdx, srcChan := range channels {
 
 		// Is this node blacklisted?
 		if blacklist[srcChan.RemotePubkey] {
@@ -92,7 +100,7 @@ func recommend(doit bool) bool {
 			continue
 		}
 
-		for dstNdx, dstChan := range rsp.Channels {
+		for dstNdx, dstChan := range channels {
 
 			// Is this node blacklisted?
 			if blacklist[dstChan.RemotePubkey] {
@@ -168,7 +176,38 @@ func recommend(doit bool) bool {
 		// Amount descending
 		return loops[ii].Amount > loops[jj].Amount
 	})
+	return loops, nil
+}
+
+// A Recommendation is a candidate loop with the amount and fee limit
+// recommend would use.
+type Recommendation struct {
+	Loop           *PotentialLoop
+	Amount         int64
+	FeeLimitRate   float64
+	RecentlyFailed bool
+}
+
+// recommendations returns the candidate loops worth trying, in the
+// order recommend considers them.
+func recommendations(channels []*lnrpc.Channel) ([]*Recommendation, error) {
+	loops, err := candidateLoops(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeChans := map[string]int{}
+	for _, chn := range channels {
+		nodeChans[chn.RemotePubkey] += 1
+	}
+
+	// The forwarding stats are only needed for earnings based limits.
+	var stats *FwdStats
+	if gCfg.Rebalance.FeeLimitMode == "earnings" {
+		stats = getFwdStats()
+	}
 
+	recs := []*Recommendation{}
 	for _, loop := range loops {
 		// Limit the rebalance amount
 		amount := loop.Amount
@@ -176,20 +215,62 @@ func recommend(doit bool) bool {
 			amount = gCfg.Recommend.TransferAmount
 		}
 
+		// Don't ask the source peer to forward more than probing
+		// found it can.
+		liquidity, known := outboundLiquidity(loop.SrcNode, nodeChans[loop.SrcNode])
+		if known && amount > liquidity {
+			if liquidity < gCfg.Recommend.MinImbalance {
+				continue
+			}
+			amount = liquidity
+		}
+
+		// Skip channels which earn nothing to pay for the rebalance.
+		limitRate := feeLimitRate(amount, loop.DstChan, loop.DstNode, stats)
+		if limitRate <= 0 {
+			continue
+		}
+
 		// Consider recent history
 		tstamp := time.Now().Unix() - int64(gCfg.Recommend.RetryInhibit.Seconds())
-		if !recentlyFailed(loop.SrcChan, loop.DstChan, tstamp, amount, gCfg.Rebalance.FeeLimitRate) {
-			if doit {
-				doRebalance(amount, loop.SrcChan, loop.DstChan)
-				return true
-			} else {
-				fmt.Printf("lndtool rebalance -a %d -s %d -d %d\n",
-					amount, loop.SrcChan, loop.DstChan)
-				return true
+		recs = append(recs, &Recommendation{
+			Loop:           loop,
+			Amount:         amount,
+			FeeLimitRate:   limitRate,
+			RecentlyFailed: recentlyFailed(loop.SrcChan, loop.DstChan, tstamp, amount, limitRate),
+		})
+	}
+	return recs, nil
+}
+
+func recommend(doit bool) (bool, error) {
+
+	maybeTakeSample()
+
+	recs, err := recommendations(recommendChannels())
+	if err != nil {
+		return false, err
+	}
+	for _, rec := range recs {
+		if rec.RecentlyFailed {
+			continue
+		}
+		loop, amount, limitRate := rec.Loop, rec.Amount, rec.FeeLimitRate
+		if doit {
+			doRebalance(amount, loop.SrcChan, loop.DstChan, limitRate)
+			return true, nil
+		} else {
+			nodeOpt := ""
+			if gCfg.Node != "" {
+				nodeOpt = " --node " + gCfg.Node
 			}
+			fmt.Printf("lndtool%s rebalance -a %d -s %s -d %s  # fee limit %.0f ppm, %d sat\n",
+				nodeOpt, amount, fmtChanId(loop.SrcChan), fmtChanId(loop.DstChan),
+				limitRate*1e6, int64(float64(amount)*limitRate))
+			return true, nil
 		}
 	}
 
 	fmt.Println("no loops recommended")
-	return false
+	return false, nil
 }
@@ -0,0 +1,210 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// A ChanSample records the state of one channel at one point in time.
+type ChanSample struct {
+	Tstamp        int64
+	ChanId        uint64
+	RemoteNode    string
+	Active        bool
+	Disabled      bool
+	Capacity      int64
+	LocalBalance  int64
+	RemoteBalance int64
+}
+
+var lastSampleTime time.Time
+
+// takeSample records the current state of every channel.
+func takeSample() int {
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{
+		ActiveOnly:   false,
+		InactiveOnly: false,
+		PublicOnly:   false,
+		PrivateOnly:  false,
+	})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+
+	lookups := lookupChannels(rsp.Channels)
+
+	now := time.Now()
+	samples := []*ChanSample{}
+	for ndx, chn := range rsp.Channels {
+		lookup := lookups[ndx]
+		samples = append(samples, &ChanSample{
+			Tstamp:        now.Unix(),
+			ChanId:        chn.ChanId,
+			RemoteNode:    chn.RemotePubkey,
+			Active:        chn.Active,
+			Disabled:      lookup.Policy != nil && lookup.Policy.Disabled,
+			Capacity:      chn.Capacity,
+			LocalBalance:  chn.LocalBalance,
+			RemoteBalance: chn.RemoteBalance,
+		})
+	}
+	insertChanSamples(samples)
+	lastSampleTime = now
+	return len(samples)
+}
+
+// maybeTakeSample takes a sample if sample.interval has passed since
+// the last one taken by this process.  The channels and recommend
+// commands call this so every run, and every autobalance cycle once the
+// interval has passed, records balances.
+func maybeTakeSample() {
+	if gCfg.Sample.Interval > 0 &&
+		time.Since(lastSampleTime) >= gCfg.Sample.Interval {
+		takeSample()
+	}
+}
+
+func runSampler(loop bool) {
+	for {
+		count := takeSample()
+		if gCfg.Verbose {
+			fmt.Printf("%s: sampled %d channels\n",
+				time.Now().Format(time.RFC3339), count)
+		}
+		if !loop || gCfg.Sample.Interval <= 0 {
+			return
+		}
+		time.Sleep(gCfg.Sample.Interval)
+	}
+}
+
+type PeerUptime struct {
+	Samples    int
+	Online     int
+	Flaps      int
+	LastOnline int64
+}
+
+func (pu *PeerUptime) Fraction() float64 {
+	if pu.Samples == 0 {
+		return 0
+	}
+	return float64(pu.Online) / float64(pu.Samples)
+}
+
+// peerUptime computes per-peer uptime from the samples taken since the
+// given time.  A peer is online at a sample if any channel to it is
+// active; a flap is a transition from online to offline.
+func peerUptime(since time.Time) map[string]*PeerUptime {
+	// Collapse the channel samples into peer samples.
+	type peerSample struct {
+		tstamp int64
+		online bool
+	}
+	byPeer := map[string][]*peerSample{}
+	for _, sample := range selectChanSamples(since.Unix(), 0) {
+		psamples := byPeer[sample.RemoteNode]
+		ll := len(psamples)
+		if ll > 0 && psamples[ll-1].tstamp == sample.Tstamp {
+			psamples[ll-1].online = psamples[ll-1].online || sample.Active
+		} else {
+			byPeer[sample.RemoteNode] = append(psamples, &peerSample{
+				tstamp: sample.Tstamp,
+				online: sample.Active,
+			})
+		}
+	}
+
+	retval := map[string]*PeerUptime{}
+	for peer, psamples := range byPeer {
+		pu := &PeerUptime{}
+		for ndx, ps := range psamples {
+			pu.Samples += 1
+			if ps.online {
+				pu.Online += 1
+				pu.LastOnline = ps.tstamp
+			} else if ndx > 0 && psamples[ndx-1].online {
+				pu.Flaps += 1
+			}
+		}
+		retval[peer] = pu
+	}
+	return retval
+}
+
+func fmtLastSeen(tstamp int64) string {
+	if tstamp == 0 {
+		return "never"
+	}
+	ago := time.Since(time.Unix(tstamp, 0))
+	if ago < gCfg.Sample.Interval {
+		return "now"
+	}
+	return ago.Round(time.Minute).String()
+}
+
+func uptimeReport(windows []time.Duration) {
+	if len(windows) == 0 {
+		windows = []time.Duration{
+			time.Hour * 24,
+			time.Hour * 24 * 7,
+			time.Hour * 24 * 30,
+		}
+	}
+	sort.Slice(windows, func(ii, jj int) bool {
+		return windows[ii] < windows[jj]
+	})
+
+	now := time.Now()
+	uptimes := []map[string]*PeerUptime{}
+	for _, window := range windows {
+		uptimes = append(uptimes, peerUptime(now.Add(-window)))
+	}
+
+	// The longest window has every peer.
+	peers := []string{}
+	for peer := range uptimes[len(uptimes)-1] {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	hdr := ""
+	for _, window := range windows {
+		hdr += fmt.Sprintf(" %8s Flp", window.String())
+	}
+	color.Bold.Printf("%s %12s %-66s Alias\n", hdr, "LastOnline", "PubKey")
+
+	for _, peer := range peers {
+		str := ""
+		for ndx := range windows {
+			pu := uptimes[ndx][peer]
+			if pu == nil || pu.Samples == 0 {
+				str += fmt.Sprintf(" %8s %3s", "-", "-")
+			} else {
+				str += fmt.Sprintf(" %7.1f%% %3d", pu.Fraction()*100, pu.Flaps)
+			}
+		}
+
+		alias := ""
+		nodeInfo, err := getNodeInfo(peer)
+		if err == nil {
+			alias = nodeInfo.Alias
+		}
+
+		longest := uptimes[len(uptimes)-1][peer]
+		str += fmt.Sprintf(" %12s %s %s",
+			fmtLastSeen(longest.LastOnline), abbrevPubKey(peer), alias)
+
+		if longest.Fraction() < 0.9 {
+			color.Yellow.Println(str)
+		} else {
+			color.Black.Println(str)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// The API server shares the global connection, caches and database
+// with the commands, none of which expect concurrent use, so requests
+// are handled one at a time.  A rebalance holds up the other requests
+// until it's done.
+var gServeMtx sync.Mutex
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiFwdStats struct {
+	CountRcv   uint64 `json:"count_rcv"`
+	AmountRcv  uint64 `json:"amount_rcv"`
+	FeeMsatRcv uint64 `json:"fee_msat_rcv"`
+	CountSnd   uint64 `json:"count_snd"`
+	AmountSnd  uint64 `json:"amount_snd"`
+	FeeMsatSnd uint64 `json:"fee_msat_snd"`
+}
+
+type apiChannel struct {
+	ChanId        uint64      `json:"chan_id"`
+	ShortChanId   string      `json:"short_chan_id"`
+	ChannelPoint  string      `json:"channel_point"`
+	PubKey        string      `json:"pubkey"`
+	Alias         string      `json:"alias"`
+	Active        bool        `json:"active"`
+	Disabled      bool        `json:"disabled"`
+	Private       bool        `json:"private"`
+	Capacity      int64       `json:"capacity"`
+	LocalBalance  int64       `json:"local_balance"`
+	RemoteBalance int64       `json:"remote_balance"`
+	Imbalance     int64       `json:"imbalance"`
+	Age           uint32      `json:"age_blocks"`
+	Fwd           apiFwdStats `json:"fwd"`
+	Error         string      `json:"error,omitempty"`
+}
+
+type apiPeer struct {
+	PubKey          string  `json:"pubkey"`
+	Alias           string  `json:"alias"`
+	NumChans        int     `json:"num_chans"`
+	Capacity        int64   `json:"capacity"`
+	LocalBalance    int64   `json:"local_balance"`
+	RemoteBalance   int64   `json:"remote_balance"`
+	Imbalance       int64   `json:"imbalance"`
+	FwdRcv          uint64  `json:"fwd_rcv"`
+	FwdSnd          uint64  `json:"fwd_snd"`
+	FeeMsat         uint64  `json:"fee_msat"`
+	Uptime          float64 `json:"uptime"`
+	LoopAttempts    int     `json:"loop_attempts"`
+	LoopSuccesses   int     `json:"loop_successes"`
+	LoopSuccessRate float64 `json:"loop_success_rate"`
+}
+
+type apiRecommendation struct {
+	SrcChan        uint64 `json:"src_chan"`
+	SrcNode        string `json:"src_node"`
+	SrcAlias       string `json:"src_alias"`
+	DstChan        uint64 `json:"dst_chan"`
+	DstNode        string `json:"dst_node"`
+	DstAlias       string `json:"dst_alias"`
+	Amount         int64  `json:"amount"`
+	FeeLimitPPM    int64  `json:"fee_limit_ppm"`
+	RecentlyFailed bool   `json:"recently_failed"`
+}
+
+type apiLoopAttempt struct {
+	Tstamp          int64  `json:"tstamp"`
+	SrcChan         uint64 `json:"src_chan"`
+	SrcNode         string `json:"src_node"`
+	DstChan         uint64 `json:"dst_chan"`
+	DstNode         string `json:"dst_node"`
+	Amount          int64  `json:"amount"`
+	FeeLimitPPM     int64  `json:"fee_limit_ppm"`
+	Outcome         string `json:"outcome"` // "success", "no_routes" or "failure"
+	FeeMsat         int64  `json:"fee_msat"`
+	InternalFeeMsat int64  `json:"internal_fee_msat"`
+}
+
+// apiRebalanceRequest takes channels and peers as the rebalance
+// command's --source and --destination do.  The fee limit defaults to
+// the one rebalance would use.
+type apiRebalanceRequest struct {
+	Amount      int64  `json:"amount"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	FeeLimitPPM int64  `json:"fee_limit_ppm,omitempty"`
+}
+
+type apiRebalanceResponse struct {
+	SrcChan     uint64          `json:"src_chan"`
+	DstChan     uint64          `json:"dst_chan"`
+	Amount      int64           `json:"amount"`
+	FeeLimitPPM int64           `json:"fee_limit_ppm"`
+	Success     bool            `json:"success"`
+	Attempt     *apiLoopAttempt `json:"attempt,omitempty"`
+}
+
+func newApiLoopAttempt(attempt *LoopAttempt) *apiLoopAttempt {
+	outcome := "success"
+	switch attempt.Outcome {
+	case LoopAttemptNoRoutes:
+		outcome = "no_routes"
+	case LoopAttemptFailure:
+		outcome = "failure"
+	}
+	return &apiLoopAttempt{
+		Tstamp:          attempt.Tstamp,
+		SrcChan:         attempt.SrcChan,
+		SrcNode:         attempt.SrcNode,
+		DstChan:         attempt.DstChan,
+		DstNode:         attempt.DstNode,
+		Amount:          attempt.Amount,
+		FeeLimitPPM:     int64(attempt.FeeLimitRate * 1e6),
+		Outcome:         outcome,
+		FeeMsat:         attempt.FeeMsat,
+		InternalFeeMsat: attempt.InternalFeeMsat,
+	}
+}
+
+// An httpError is returned by the handlers to answer with its status.
+type httpError struct {
+	Status int
+	Err    error
+}
+
+func (err *httpError) Error() string {
+	return err.Err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func writeJSON(ww http.ResponseWriter, status int, value interface{}) {
+	ww.Header().Set("Content-Type", "application/json")
+	ww.WriteHeader(status)
+	enc := json.NewEncoder(ww)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+}
+
+type apiServer struct {
+	token []byte
+}
+
+type apiHandler func(ww http.ResponseWriter, req *http.Request) error
+
+// handle wraps the handler, checking the method and the token,
+// serializing the requests and turning errors and panics, which is how
+// RPC and database failures surface, into JSON errors.
+func (server *apiServer) handle(method string, handler apiHandler) http.HandlerFunc {
+	return func(ww http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		status := http.StatusOK
+		defer func() {
+			fmt.Printf("%s %s %s %d %s\n",
+				start.Format("2006-01-02 15:04:05"), req.Method, req.URL,
+				status, time.Since(start).Round(time.Millisecond))
+		}()
+		fail := func(code int, err error) {
+			status = code
+			writeJSON(ww, code, &apiError{err.Error()})
+		}
+
+		if req.Method != method {
+			ww.Header().Set("Allow", method)
+			fail(http.StatusMethodNotAllowed, fmt.Errorf("use %s", method))
+			return
+		}
+		if !server.authorized(req) {
+			ww.Header().Set("WWW-Authenticate", "Bearer")
+			fail(http.StatusUnauthorized, fmt.Errorf("bad or missing token"))
+			return
+		}
+
+		gServeMtx.Lock()
+		defer gServeMtx.Unlock()
+		defer func() {
+			if rr := recover(); rr != nil {
+				fmt.Fprintf(os.Stderr, "%s %s panicked: %v\n", req.Method, req.URL, rr)
+				fail(http.StatusInternalServerError, fmt.Errorf("%v", rr))
+			}
+		}()
+		if err := handler(ww, req); err != nil {
+			if herr, ok := err.(*httpError); ok {
+				fail(herr.Status, herr.Err)
+			} else {
+				fail(http.StatusInternalServerError, err)
+			}
+		}
+	}
+}
+
+func (server *apiServer) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	return subtle.ConstantTimeCompare(token, server.token) == 1
+}
+
+// checkSortKey refuses sort keys the list doesn't offer.
+func checkSortKey(key string, keys []string) error {
+	for _, valid := range keys {
+		if key == valid {
+			return nil
+		}
+	}
+	return badRequest("bad sort %q, expected one of %s",
+		key, strings.Join(keys, ", "))
+}
+
+// GET /channels takes the channels command's sort, reverse and peer
+// options as query parameters.
+func serveChannels(ww http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+	sortKey := query.Get("sort")
+	if sortKey == "" {
+		sortKey = "chanid"
+	}
+	if err := checkSortKey(sortKey, chanSortKeys); err != nil {
+		return err
+	}
+	reverse, _ := strconv.ParseBool(query.Get("reverse"))
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		panic(fmt.Sprint("GetInfo failed:", err))
+	}
+	rows := chanRows(allChannels(), getFwdStats(), info.BlockHeight)
+	if peer := query.Get("peer"); peer != "" {
+		matchPeer, err := peerMatcher(peer)
+		if err != nil {
+			return badRequest("bad peer: %v", err)
+		}
+		matched := []*ChanRow{}
+		for _, row := range rows {
+			if matchPeer(row.Chan.RemotePubkey, row.Alias()) {
+				matched = append(matched, row)
+			}
+		}
+		rows = matched
+	}
+	sortChanRows(rows, sortKey, reverse)
+
+	channels := []*apiChannel{}
+	for _, row := range rows {
+		chn := row.Chan
+		channel := &apiChannel{
+			ChanId:        chn.ChanId,
+			ShortChanId:   shortChanId(chn.ChanId),
+			ChannelPoint:  chn.ChannelPoint,
+			PubKey:        chn.RemotePubkey,
+			Alias:         row.Alias(),
+			Active:        chn.Active,
+			Disabled:      row.Disabled(),
+			Private:       chn.Private,
+			Capacity:      chn.Capacity,
+			LocalBalance:  chn.LocalBalance,
+			RemoteBalance: chn.RemoteBalance,
+			Imbalance:     row.Imbalance,
+			Age:           row.Age,
+		}
+		if row.Lookup != nil && row.Lookup.Err != nil {
+			channel.Error = row.Lookup.Err.Error()
+		}
+		if stats := row.FwdStats; stats != nil {
+			channel.Fwd = apiFwdStats{
+				stats.CountRcv, stats.AmountRcv, stats.FeeMsatRcv,
+				stats.CountSnd, stats.AmountSnd, stats.FeeMsatSnd,
+			}
+		}
+		channels = append(channels, channel)
+	}
+	writeJSON(ww, http.StatusOK, channels)
+	return nil
+}
+
+// GET /peers takes the peers command's sort option.
+func servePeers(ww http.ResponseWriter, req *http.Request) error {
+	sortKey := req.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "capacity"
+	}
+	if err := checkSortKey(sortKey, peerSortKeys); err != nil {
+		return err
+	}
+	rows := gatherPeers()
+	sortPeerRows(rows, sortKey)
+
+	peers := []*apiPeer{}
+	for _, row := range rows {
+		peers = append(peers, &apiPeer{
+			PubKey:          row.PubKey,
+			Alias:           row.Alias,
+			NumChans:        row.NumChans,
+			Capacity:        row.Capacity,
+			LocalBalance:    row.LocalBalance,
+			RemoteBalance:   row.RemoteBalance,
+			Imbalance:       row.Imbalance(),
+			FwdRcv:          row.FwdRcv,
+			FwdSnd:          row.FwdSnd,
+			FeeMsat:         row.FeeMsat,
+			Uptime:          row.UptimeFraction(),
+			LoopAttempts:    row.LoopStats.Attempts,
+			LoopSuccesses:   row.LoopStats.Successes,
+			LoopSuccessRate: row.LoopSuccessRate(),
+		})
+	}
+	writeJSON(ww, http.StatusOK, peers)
+	return nil
+}
+
+// GET /recommendations lists every loop recommend considers, including
+// the ones it skips because they failed recently.
+func serveRecommendations(ww http.ResponseWriter, req *http.Request) error {
+	loops, err := recommendations(recommendChannels())
+	if err != nil {
+		return err
+	}
+	recs := []*apiRecommendation{}
+	for _, rec := range loops {
+		recs = append(recs, &apiRecommendation{
+			SrcChan:        rec.Loop.SrcChan,
+			SrcNode:        rec.Loop.SrcNode,
+			SrcAlias:       probeAlias(rec.Loop.SrcNode),
+			DstChan:        rec.Loop.DstChan,
+			DstNode:        rec.Loop.DstNode,
+			DstAlias:       probeAlias(rec.Loop.DstNode),
+			Amount:         rec.Amount,
+			FeeLimitPPM:    int64(rec.FeeLimitRate * 1e6),
+			RecentlyFailed: rec.RecentlyFailed,
+		})
+	}
+	writeJSON(ww, http.StatusOK, recs)
+	return nil
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 10000
+	maxRequestBody      = 64 * 1024
+)
+
+// GET /history returns the latest loop attempts, newest first.
+func serveHistory(ww http.ResponseWriter, req *http.Request) error {
+	limit := defaultHistoryLimit
+	if str := req.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			return badRequest("limit must be between 1 and %d", maxHistoryLimit)
+		}
+	}
+
+	attempts := []*apiLoopAttempt{}
+	for _, attempt := range selectLoopAttempts(limit) {
+		attempts = append(attempts, newApiLoopAttempt(attempt))
+	}
+	writeJSON(ww, http.StatusOK, attempts)
+	return nil
+}
+
+// POST /rebalance needs an Idempotency-Key header.  The response is
+// stored under the key, a retry with the same key and request gets it
+// again instead of rebalancing twice.
+func serveRebalance(ww http.ResponseWriter, req *http.Request) error {
+	key := req.Header.Get("Idempotency-Key")
+	if key == "" {
+		return badRequest("the Idempotency-Key header is required")
+	}
+
+	var rebReq apiRebalanceRequest
+	req.Body = http.MaxBytesReader(ww, req.Body, maxRequestBody)
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rebReq); err != nil {
+		return badRequest("bad request body: %v", err)
+	}
+	canonical, err := json.Marshal(&rebReq)
+	if err != nil {
+		return err
+	}
+
+	if prev := selectRebalanceRequest(key); prev != nil {
+		if prev.Request != string(canonical) {
+			return &httpError{http.StatusUnprocessableEntity,
+				fmt.Errorf("Idempotency-Key %s was used for a different request", key)}
+		}
+		if prev.Status == 0 {
+			return &httpError{http.StatusConflict,
+				fmt.Errorf("the rebalance for Idempotency-Key %s didn't finish", key)}
+		}
+		ww.Header().Set("Content-Type", "application/json")
+		ww.Header().Set("Idempotent-Replayed", "true")
+		ww.WriteHeader(prev.Status)
+		ww.Write([]byte(prev.Response))
+		return nil
+	}
+
+	if rebReq.Amount <= 0 {
+		return badRequest("amount must be positive")
+	}
+	if rebReq.FeeLimitPPM < 0 {
+		return badRequest("fee_limit_ppm can't be negative")
+	}
+	var srcArg, dstArg chanArg
+	if err := srcArg.UnmarshalFlag(rebReq.Source); err != nil {
+		return badRequest("bad source: %v", err)
+	}
+	if err := dstArg.UnmarshalFlag(rebReq.Destination); err != nil {
+		return badRequest("bad destination: %v", err)
+	}
+	src, err := srcArg.resolveBest(mostLocal)
+	if err != nil {
+		return badRequest("source: %v", err)
+	}
+	dst, err := dstArg.resolveBest(mostRemote)
+	if err != nil {
+		return badRequest("destination: %v", err)
+	}
+	limitRate := float64(rebReq.FeeLimitPPM) / 1e6
+	if rebReq.FeeLimitPPM == 0 {
+		limitRate = chanFeeLimitRate(rebReq.Amount, dst)
+	}
+
+	// Record the key before rebalancing, so a retry while this runs
+	// or after a crash can't rebalance again.
+	insertRebalanceRequest(key, &RebalanceRequest{
+		Tstamp:  time.Now().Unix(),
+		Request: string(canonical),
+	})
+
+	status := http.StatusOK
+	var rsp interface{}
+	func() {
+		defer func() {
+			if rr := recover(); rr != nil {
+				status = http.StatusInternalServerError
+				rsp = &apiError{fmt.Sprint(rr)}
+			}
+		}()
+		start := time.Now().Unix()
+		rebRsp := &apiRebalanceResponse{
+			SrcChan:     src,
+			DstChan:     dst,
+			Amount:      rebReq.Amount,
+			FeeLimitPPM: int64(limitRate * 1e6),
+			Success:     doRebalance(rebReq.Amount, src, dst, limitRate),
+		}
+		for _, attempt := range selectLoopAttempts(1) {
+			if attempt.Tstamp >= start &&
+				attempt.SrcChan == src && attempt.DstChan == dst {
+				rebRsp.Attempt = newApiLoopAttempt(attempt)
+			}
+		}
+		rsp = rebRsp
+	}()
+
+	body, err := json.MarshalIndent(rsp, "", "  ")
+	if err != nil {
+		return err
+	}
+	updateRebalanceRequest(key, status, string(body))
+
+	ww.Header().Set("Content-Type", "application/json")
+	ww.WriteHeader(status)
+	ww.Write(body)
+	return nil
+}
+
+// readToken returns the token given with --token, or the first line of
+// --tokenfile.
+func readToken(token, tokenFile string) (string, error) {
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(cleanAndExpandPath(tokenFile))
+		if err != nil {
+			return "", err
+		}
+		token = strings.SplitN(string(data), "\n", 2)[0]
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("serve needs a token, set --token, LNDTOOL_SERVE_TOKEN or --tokenfile")
+	}
+	return token, nil
+}
+
+func serve(listen, token, tokenFile string) error {
+	token, err := readToken(token, tokenFile)
+	if err != nil {
+		return err
+	}
+	server := &apiServer{token: []byte(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channels", server.handle(http.MethodGet, serveChannels))
+	mux.HandleFunc("/peers", server.handle(http.MethodGet, servePeers))
+	mux.HandleFunc("/recommendations", server.handle(http.MethodGet, serveRecommendations))
+	mux.HandleFunc("/history", server.handle(http.MethodGet, serveHistory))
+	mux.HandleFunc("/rebalance", server.handle(http.MethodPost, serveRebalance))
+
+	fmt.Printf("listening on %s\n", listen)
+	httpServer := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return httpServer.ListenAndServe()
+}
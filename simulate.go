@@ -0,0 +1,180 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gookit/color"
+)
+
+type SimulatedOpen struct {
+	PubKey   string
+	Capacity int64
+	FeeRate  int64 // ppm, -1 means use our median fee rate
+}
+
+// parseSimulatedOpen parses "<pubkey>:<capacity>[:<feerate>]".
+func parseSimulatedOpen(spec string) (*SimulatedOpen, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf(
+			"bad --simulate-open %q, want <pubkey>:<capacity>[:<feerate>]", spec)
+	}
+	capacity, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad capacity in --simulate-open %q: %v", spec, err)
+	}
+	feeRate := int64(-1)
+	if len(fields) == 3 {
+		feeRate, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad feerate in --simulate-open %q: %v", spec, err)
+		}
+	}
+	return &SimulatedOpen{
+		PubKey:   fields[0],
+		Capacity: capacity,
+		FeeRate:  feeRate,
+	}, nil
+}
+
+type Distance struct {
+	NumHops       int
+	CumulativeFee float64
+}
+
+func snapshotDistances(graph *Graph) map[*Node]Distance {
+	retval := map[*Node]Distance{}
+	for _, node := range graph.Nodes {
+		retval[node] = Distance{node.NumHops, node.CumulativeFee}
+	}
+	return retval
+}
+
+func hopHistogram(dists map[*Node]Distance) map[int]int {
+	retval := map[int]int{}
+	for _, dist := range dists {
+		retval[dist.NumHops] += 1
+	}
+	return retval
+}
+
+func feeQuantiles(dists map[*Node]Distance) []int64 {
+	fees := []int64{}
+	for _, dist := range dists {
+		if dist.NumHops > 0 {
+			fees = append(fees, int64(dist.CumulativeFee))
+		}
+	}
+	return quantiles(fees, statsQuantiles)
+}
+
+func simulateOpens(specs []string) error {
+	opens := []*SimulatedOpen{}
+	for _, spec := range specs {
+		open, err := parseSimulatedOpen(spec)
+		if err != nil {
+			return err
+		}
+		opens = append(opens, open)
+	}
+
+	graph, err := loadGraph()
+	if err != nil {
+		return err
+	}
+	if graph.OurNode == nil {
+		return fmt.Errorf("our node is not in the graph")
+	}
+	peers := []*Node{}
+	for _, open := range opens {
+		peer := graph.Nodes[open.PubKey]
+		if peer == nil {
+			return fmt.Errorf("%s is not in the graph", open.PubKey)
+		}
+		peers = append(peers, peer)
+	}
+
+	graph.OurNode.Propagate(0, 0, graph.Cost)
+	before := snapshotDistances(graph)
+
+	ourFeeRate := medianFeeRate(graph.OurNode)
+	for ndx, open := range opens {
+		feeRate := open.FeeRate
+		if feeRate < 0 {
+			feeRate = ourFeeRate
+		}
+		graph.AddVirtualChannel(peers[ndx], open.Capacity, feeRate)
+		fmt.Printf("simulating %d sat channel at %d ppm to %s %s\n",
+			open.Capacity, feeRate, open.PubKey, peers[ndx].Alias)
+	}
+	fmt.Println()
+
+	graph.ResetDistances()
+	graph.OurNode.Propagate(0, 0, graph.Cost)
+	after := snapshotDistances(graph)
+
+	// Hop count distribution, -1 is unreachable.
+	histBefore := hopHistogram(before)
+	histAfter := hopHistogram(after)
+	hops := []int{}
+	for hh := range histBefore {
+		hops = append(hops, hh)
+	}
+	for hh := range histAfter {
+		if _, ok := histBefore[hh]; !ok {
+			hops = append(hops, hh)
+		}
+	}
+	sort.Ints(hops)
+	color.Bold.Println("Hops   Before    After   Change")
+	for _, hh := range hops {
+		label := strconv.Itoa(hh)
+		if hh == -1 {
+			label = "none"
+		}
+		fmt.Printf("%4s %8d %8d %+8d\n",
+			label, histBefore[hh], histAfter[hh], histAfter[hh]-histBefore[hh])
+	}
+	fmt.Println()
+
+	color.Bold.Printf("%-12s %10s %10s %10s %10s %10s\n",
+		"CumFee (sat)", "10%", "25%", "50%", "75%", "90%")
+	for _, row := range []struct {
+		label string
+		dists map[*Node]Distance
+	}{{"before", before}, {"after", after}} {
+		fmt.Printf("%-12s", row.label)
+		for _, vv := range feeQuantiles(row.dists) {
+			fmt.Printf(" %10d", vv)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+
+	// Which of the nodes farside would have selected are now close?
+	closer := []*Node{}
+	for node, dist := range before {
+		if dist.NumHops > 2 && after[node].NumHops != -1 &&
+			after[node].NumHops <= 2 {
+			closer = append(closer, node)
+		}
+	}
+	sort.Slice(closer, func(ii, jj int) bool {
+		return closer[ii].Capacity() > closer[jj].Capacity()
+	})
+	color.Bold.Printf("%d previously far nodes within 2 hops\n", len(closer))
+	for _, node := range closer {
+		fmt.Printf("%s %2d -> %2d %9.2f -> %9.2f %s\n",
+			node.PubKey,
+			before[node].NumHops, after[node].NumHops,
+			before[node].CumulativeFee, after[node].CumulativeFee,
+			node.Alias,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Each factor is a percentile in [0, 1] where higher is more
+// attractive; the score is their weighted average.
+type PeerCandidate struct {
+	Node *Node
+
+	Distance   float64
+	Centrality float64
+	Channels   float64
+	Capacity   float64
+	Fees       float64
+	Age        float64
+	Reach      float64
+	Score      float64
+
+	Betweenness float64
+	MedianFee   int64  // median outbound fee rate, ppm
+	AgeBlocks   uint32 // blocks since the node's oldest channel
+	Addr        string // clearnet, tor or none
+}
+
+// medianFeeRate returns the median outbound fee rate of a node in ppm.
+func medianFeeRate(node *Node) int64 {
+	rates := []int64{}
+	for _, policy := range node.Policy {
+		rates = append(rates, policy.FeeRateMilliMsat)
+	}
+	if len(rates) == 0 {
+		return 0
+	}
+	sort.Slice(rates, func(ii, jj int) bool { return rates[ii] < rates[jj] })
+	return rates[len(rates)/2]
+}
+
+// nodeAge returns the number of blocks since the node's oldest
+// announced channel was confirmed.
+func nodeAge(node *Node, height uint32) uint32 {
+	oldest := height
+	for _, edge := range node.Edges {
+		if hh := chanHeight(edge.ChannelId); hh < oldest {
+			oldest = hh
+		}
+	}
+	return height - oldest
+}
+
+func addrReach(addrs []*lnrpc.NodeAddress) (string, float64) {
+	tor := false
+	for _, addr := range addrs {
+		if strings.Contains(addr.Addr, ".onion") {
+			tor = true
+		} else {
+			return "clearnet", 1.0
+		}
+	}
+	if tor {
+		return "tor", 0.5
+	}
+	return "none", 0.0
+}
+
+func suggestPeers(count int) error {
+	graph, err := loadGraph()
+	if err != nil {
+		return err
+	}
+	if graph.OurNode == nil {
+		return fmt.Errorf("our node is not in the graph")
+	}
+	graph.OurNode.Propagate(0, 0, graph.Cost)
+
+	// Skip the nodes we already have (or are opening) channels with.
+	existing := map[string]bool{graph.OurNode.PubKey: true}
+	rsp, err := gClient.ListChannels(gCtx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("ListChannels failed:", err))
+	}
+	for _, chn := range rsp.Channels {
+		existing[chn.RemotePubkey] = true
+	}
+	pending, err := gClient.PendingChannels(gCtx, &lnrpc.PendingChannelsRequest{})
+	if err != nil {
+		panic(fmt.Sprint("PendingChannels failed:", err))
+	}
+	for _, chn := range pending.PendingOpenChannels {
+		existing[chn.Channel.RemoteNodePub] = true
+	}
+
+	betweenness := graph.Betweenness(gCfg.Graph.CentralitySamples)
+
+	// Gather the raw factors of the reachable candidates.
+	hops := map[*Node]float64{}
+	fees := map[*Node]float64{}
+	between := map[*Node]float64{}
+	numChans := map[*Node]float64{}
+	capacity := map[*Node]float64{}
+	feeRates := map[*Node]float64{}
+	ages := map[*Node]float64{}
+	for _, node := range graph.Nodes {
+		if existing[node.PubKey] || node.NumHops < 1 {
+			continue
+		}
+		hops[node] = float64(node.NumHops)
+		fees[node] = node.CumulativeFee
+		between[node] = betweenness[node]
+		numChans[node] = float64(node.NumChan())
+		capacity[node] = float64(node.Capacity())
+		feeRates[node] = -float64(medianFeeRate(node)) // cheaper is better
+		ages[node] = float64(nodeAge(node, graph.Height))
+	}
+
+	hopsPct := percentiles(hops)
+	feesPct := percentiles(fees)
+	betweenPct := percentiles(between)
+	numChansPct := percentiles(numChans)
+	capacityPct := percentiles(capacity)
+	feeRatesPct := percentiles(feeRates)
+	agesPct := percentiles(ages)
+
+	weights := gCfg.Suggest
+	sumWeights := weights.DistanceWeight + weights.CentralityWeight +
+		weights.ChannelsWeight + weights.CapacityWeight +
+		weights.FeesWeight + weights.AgeWeight + weights.ReachWeight
+	if sumWeights <= 0 {
+		return fmt.Errorf("suggest weights must add up to more than zero")
+	}
+
+	candidates := []*PeerCandidate{}
+	for node := range hops {
+		cand := &PeerCandidate{
+			Node:        node,
+			Distance:    (hopsPct[node] + feesPct[node]) / 2,
+			Centrality:  betweenPct[node],
+			Channels:    numChansPct[node],
+			Capacity:    capacityPct[node],
+			Fees:        feeRatesPct[node],
+			Age:         agesPct[node],
+			Betweenness: betweenness[node],
+			MedianFee:   medianFeeRate(node),
+			AgeBlocks:   nodeAge(node, graph.Height),
+		}
+		cand.Addr, cand.Reach = addrReach(node.Addresses)
+		cand.Score = (cand.Distance*weights.DistanceWeight +
+			cand.Centrality*weights.CentralityWeight +
+			cand.Channels*weights.ChannelsWeight +
+			cand.Capacity*weights.CapacityWeight +
+			cand.Fees*weights.FeesWeight +
+			cand.Age*weights.AgeWeight +
+			cand.Reach*weights.ReachWeight) / sumWeights
+		candidates = append(candidates, cand)
+	}
+
+	sort.SliceStable(candidates, func(ii, jj int) bool {
+		return candidates[ii].Score > candidates[jj].Score
+	})
+	if count > 0 && len(candidates) > count {
+		candidates = candidates[:count]
+	}
+
+	color.Bold.Println("Score Dist Cent Chan  Cap  Fee  Age Rch Hops  CumFee  Between  Chn  Log   PPM   Age Addr     PubKey                                                             Alias")
+	for _, cand := range candidates {
+		node := cand.Node
+		fmt.Printf("%5.1f %4.0f %4.0f %4.0f %4.0f %4.0f %4.0f %3.0f %4d %7.2f %8.0f %4d %4.1f %5d %5d %-8s %s %s\n",
+			cand.Score*100,
+			cand.Distance*100,
+			cand.Centrality*100,
+			cand.Channels*100,
+			cand.Capacity*100,
+			cand.Fees*100,
+			cand.Age*100,
+			cand.Reach*100,
+			node.NumHops,
+			node.CumulativeFee,
+			cand.Betweenness,
+			node.NumChan(),
+			math.Log10(float64(node.Capacity()+1)),
+			cand.MedianFee,
+			cand.AgeBlocks,
+			cand.Addr,
+			node.PubKey,
+			node.Alias,
+		)
+	}
+	return nil
+}
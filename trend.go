@@ -0,0 +1,164 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+)
+
+type ChanTrend struct {
+	ChanId     uint64
+	RemoteNode string
+	Samples    []*ChanSample
+	DrainRate  float64 // local balance change in sat/day, negative drains
+}
+
+func localRatio(sample *ChanSample) float64 {
+	total := sample.LocalBalance + sample.RemoteBalance
+	if total == 0 {
+		return 0
+	}
+	return float64(sample.LocalBalance) / float64(total)
+}
+
+// drainRate fits a least squares line to the local balance over time
+// and returns its slope in sat/day.
+func drainRate(samples []*ChanSample) float64 {
+	nn := float64(len(samples))
+	if nn < 2 {
+		return 0
+	}
+	t0 := samples[0].Tstamp
+	sumX, sumY, sumXY, sumXX := 0.0, 0.0, 0.0, 0.0
+	for _, sample := range samples {
+		xx := float64(sample.Tstamp-t0) / 86400
+		yy := float64(sample.LocalBalance)
+		sumX += xx
+		sumY += yy
+		sumXY += xx * yy
+		sumXX += xx * xx
+	}
+	denom := nn*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0
+	}
+	return (nn*sumXY - sumX*sumY) / denom
+}
+
+// projectedDays returns the projected time in days until the side the
+// channel is draining towards is empty, or -1 if it isn't draining.
+func projectedDays(trend *ChanTrend) float64 {
+	last := trend.Samples[len(trend.Samples)-1]
+	if trend.DrainRate < 0 {
+		return float64(last.LocalBalance) / -trend.DrainRate
+	} else if trend.DrainRate > 0 {
+		return float64(last.RemoteBalance) / trend.DrainRate
+	}
+	return -1
+}
+
+func depletion(trend *ChanTrend) string {
+	days := projectedDays(trend)
+	if days < 0 {
+		return "-"
+	}
+	side := "local"
+	if trend.DrainRate > 0 {
+		side = "remote"
+	}
+	return fmt.Sprintf("%s %.1fd", side, days)
+}
+
+func chanTrends(window time.Duration, theChan uint64) []*ChanTrend {
+	since := time.Now().Add(-window).Unix()
+	trends := map[uint64]*ChanTrend{}
+	for _, sample := range selectChanSamples(since, theChan) {
+		trend := trends[sample.ChanId]
+		if trend == nil {
+			trend = &ChanTrend{
+				ChanId:     sample.ChanId,
+				RemoteNode: sample.RemoteNode,
+			}
+			trends[sample.ChanId] = trend
+		}
+		trend.Samples = append(trend.Samples, sample)
+	}
+
+	retval := []*ChanTrend{}
+	for _, trend := range trends {
+		trend.DrainRate = drainRate(trend.Samples)
+		retval = append(retval, trend)
+	}
+	sort.Slice(retval, func(ii, jj int) bool {
+		return retval[ii].ChanId < retval[jj].ChanId
+	})
+	return retval
+}
+
+func trendReport(window time.Duration, theChan uint64) error {
+	trends := chanTrends(window, theChan)
+	if len(trends) == 0 {
+		return fmt.Errorf("no samples in the last %v", window)
+	}
+
+	if theChan != 0 {
+		dumpChanSamples(trends[0])
+		fmt.Println()
+	}
+
+	idWidth := chanIdWidth()
+	color.Bold.Printf("%*s Samples  Capacity First  Last  Sat/Day Depletes   PubKey                                                             Alias\n",
+		idWidth, "ChanId")
+	for _, trend := range trends {
+		first := trend.Samples[0]
+		last := trend.Samples[len(trend.Samples)-1]
+
+		alias := ""
+		nodeInfo, err := getNodeInfo(trend.RemoteNode)
+		if err == nil {
+			alias = nodeInfo.Alias
+		}
+
+		str := fmt.Sprintf("%*s %7d %9d %4.0f%% %4.0f%% %8.0f %-10s %s %s",
+			idWidth, fmtChanId(trend.ChanId),
+			len(trend.Samples),
+			last.Capacity,
+			localRatio(first)*100,
+			localRatio(last)*100,
+			trend.DrainRate,
+			depletion(trend),
+			abbrevPubKey(trend.RemoteNode),
+			alias,
+		)
+
+		// Highlight channels which will be empty within a week.
+		if days := projectedDays(trend); days >= 0 && days < 7 {
+			color.Yellow.Println(str)
+		} else {
+			color.Black.Println(str)
+		}
+	}
+	return nil
+}
+
+// dumpChanSamples shows the local ratio of a single channel over time.
+func dumpChanSamples(trend *ChanTrend) {
+	const barWidth = 40
+	color.Bold.Println("Time                 Local    Remote Ratio")
+	for _, sample := range trend.Samples {
+		ratio := localRatio(sample)
+		bar := strings.Repeat("#", int(ratio*barWidth+0.5))
+		fmt.Printf("%s %9d %9d %4.0f%% |%-40s|\n",
+			time.Unix(sample.Tstamp, 0).Format("2006-01-02 15:04"),
+			sample.LocalBalance,
+			sample.RemoteBalance,
+			ratio*100,
+			bar,
+		)
+	}
+}
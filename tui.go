@@ -0,0 +1,542 @@
+// Copyright 2019 Bonsai Software, Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/gookit/color"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rivo/tview"
+)
+
+const tuiHistoryLength = 50
+
+// tuiData is what each refresh fetches from lnd and the database.
+type tuiData struct {
+	Rows     []*ChanRow
+	Recs     []*Recommendation
+	Attempts []*LoopAttempt
+}
+
+// The tui state is only touched from the tview event loop.
+type tui struct {
+	app      *tview.Application
+	pages    *tview.Pages
+	channels *tview.Table
+	recs     *tview.Table
+	history  *tview.Table
+	log      *tview.TextView
+	status   *tview.TextView
+	filter   *tview.InputField
+	prompt   *tview.Form
+
+	data        *tuiData
+	shown       []*ChanRow // the channel table's rows, in order
+	sortNdx     int
+	reverse     bool
+	matchPeer   func(pubkey, alias string) bool
+	srcChan     uint64
+	dstChan     uint64
+	rebalancing bool
+	refreshNow  chan bool
+}
+
+// fetchTuiData gathers everything the panes show, returning panics
+// from failed RPCs as errors so the dashboard keeps running.
+func fetchTuiData() (data *tuiData, err error) {
+	defer func() {
+		if rr := recover(); rr != nil {
+			err = fmt.Errorf("%v", rr)
+		}
+	}()
+
+	info, err := gClient.GetInfo(gCtx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetInfo failed: %v", err)
+	}
+	recs, err := recommendations(recommendChannels())
+	if err != nil {
+		return nil, err
+	}
+	return &tuiData{
+		Rows:     chanRows(allChannels(), getFwdStats(), info.BlockHeight),
+		Recs:     recs,
+		Attempts: selectLoopAttempts(tuiHistoryLength),
+	}, nil
+}
+
+func headerCell(text string) *tview.TableCell {
+	return tview.NewTableCell(text).
+		SetTextColor(tcell.ColorYellow).
+		SetSelectable(false)
+}
+
+func numCell(num int64) *tview.TableCell {
+	return tview.NewTableCell(strconv.FormatInt(num, 10)).
+		SetAlign(tview.AlignRight)
+}
+
+func (ui *tui) setStatus(format string, args ...interface{}) {
+	ui.status.SetText(fmt.Sprintf(format, args...))
+}
+
+func (ui *tui) selection() string {
+	str := ""
+	if ui.srcChan != 0 {
+		str += " src " + fmtChanId(ui.srcChan)
+	}
+	if ui.dstChan != 0 {
+		str += " dst " + fmtChanId(ui.dstChan)
+	}
+	return str
+}
+
+// showChannels fills the channel table from the last fetch, sorted and
+// filtered as chosen.
+func (ui *tui) showChannels() {
+	if ui.data == nil {
+		return
+	}
+	ui.shown = []*ChanRow{}
+	for _, row := range ui.data.Rows {
+		if ui.matchPeer == nil || ui.matchPeer(row.Chan.RemotePubkey, row.Alias()) {
+			ui.shown = append(ui.shown, row)
+		}
+	}
+	sortChanRows(ui.shown, chanSortKeys[ui.sortNdx], ui.reverse)
+
+	selRow, _ := ui.channels.GetSelection()
+	ui.channels.Clear()
+	for col, hdr := range []string{
+		"", "ChanId", "Flg", "Capacity", "Local", "Remote", "Imbalance",
+		"FwdR", "FwdS", "Alias",
+	} {
+		ui.channels.SetCell(0, col, headerCell(hdr))
+	}
+	for ndx, row := range ui.shown {
+		chn := row.Chan
+		mark := ""
+		if chn.ChanId == ui.srcChan {
+			mark = "src"
+		} else if chn.ChanId == ui.dstChan {
+			mark = "dst"
+		}
+		flags := "-"
+		if chn.Active {
+			flags = "A"
+		}
+		if row.Disabled() {
+			flags += "D"
+		}
+
+		textColor := tcell.ColorWhite
+		if !chn.Active {
+			textColor = tcell.ColorRed
+		} else if row.Imbalance > gCfg.Recommend.MinImbalance ||
+			row.Imbalance < -gCfg.Recommend.MinImbalance {
+			textColor = tcell.ColorYellow
+		}
+
+		cells := []*tview.TableCell{
+			tview.NewTableCell(mark).SetTextColor(tcell.ColorGreen),
+			tview.NewTableCell(fmtChanId(chn.ChanId)).SetAlign(tview.AlignRight),
+			tview.NewTableCell(flags),
+			numCell(chn.Capacity),
+			numCell(chn.LocalBalance),
+			numCell(chn.RemoteBalance),
+			numCell(row.Imbalance),
+			tview.NewTableCell(fmtAmountSci(float64(row.FwdStats.AmountRcv))),
+			tview.NewTableCell(fmtAmountSci(float64(row.FwdStats.AmountSnd))),
+			tview.NewTableCell(row.Alias()).SetExpansion(1),
+		}
+		for col, cell := range cells {
+			if col > 0 {
+				cell.SetTextColor(textColor)
+			}
+			ui.channels.SetCell(ndx+1, col, cell)
+		}
+	}
+	if selRow < 1 || selRow > len(ui.shown) {
+		selRow = 1
+	}
+	ui.channels.Select(selRow, 0)
+
+	dir := ""
+	if ui.reverse {
+		dir = ", reversed"
+	}
+	ui.channels.SetTitle(fmt.Sprintf(" Channels (%d, by %s%s) ",
+		len(ui.shown), chanSortKeys[ui.sortNdx], dir))
+}
+
+func (ui *tui) showRecommendations() {
+	ui.recs.Clear()
+	for col, hdr := range []string{"Src", "Dst", "Amount", "PPM"} {
+		ui.recs.SetCell(0, col, headerCell(hdr))
+	}
+	for ndx, rec := range ui.data.Recs {
+		// Loops which failed recently are shown but recommend skips them.
+		textColor := tcell.ColorWhite
+		if rec.RecentlyFailed {
+			textColor = tcell.ColorGray
+		}
+		cells := []*tview.TableCell{
+			tview.NewTableCell(probeAlias(rec.Loop.SrcNode)).SetMaxWidth(20),
+			tview.NewTableCell(probeAlias(rec.Loop.DstNode)).SetMaxWidth(20),
+			numCell(rec.Amount),
+			numCell(int64(rec.FeeLimitRate * 1e6)),
+		}
+		for col, cell := range cells {
+			ui.recs.SetCell(ndx+1, col, cell.SetTextColor(textColor))
+		}
+	}
+}
+
+func (ui *tui) showHistory() {
+	ui.history.Clear()
+	for col, hdr := range []string{"Time", "Src", "Dst", "Amount", "Fee", "Outcome"} {
+		ui.history.SetCell(0, col, headerCell(hdr))
+	}
+	for ndx, attempt := range ui.data.Attempts {
+		outcome, textColor := "ok", tcell.ColorGreen
+		switch attempt.Outcome {
+		case LoopAttemptNoRoutes:
+			outcome, textColor = "no route", tcell.ColorYellow
+		case LoopAttemptFailure:
+			outcome, textColor = "failed", tcell.ColorRed
+		}
+		tstamp := time.Unix(attempt.Tstamp, 0).Format("01-02 15:04")
+		ui.history.SetCell(ndx+1, 0, tview.NewTableCell(tstamp))
+		ui.history.SetCell(ndx+1, 1, tview.NewTableCell(probeAlias(attempt.SrcNode)).SetMaxWidth(16))
+		ui.history.SetCell(ndx+1, 2, tview.NewTableCell(probeAlias(attempt.DstNode)).SetMaxWidth(16))
+		ui.history.SetCell(ndx+1, 3, numCell(attempt.Amount))
+		ui.history.SetCell(ndx+1, 4, numCell(attempt.FeeMsat/1000))
+		ui.history.SetCell(ndx+1, 5, tview.NewTableCell(outcome).SetTextColor(textColor))
+	}
+}
+
+// refresh fetches in the background and updates the panes when done.
+func (ui *tui) refresh() {
+	data, err := fetchTuiData()
+	ui.app.QueueUpdateDraw(func() {
+		if err != nil {
+			ui.setStatus("[red]refresh failed: %v", tview.Escape(err.Error()))
+			return
+		}
+		ui.data = data
+		ui.showChannels()
+		ui.showRecommendations()
+		ui.showHistory()
+		ui.setStatus("updated %s%s", time.Now().Format("15:04:05"), ui.selection())
+	})
+}
+
+func (ui *tui) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ui.refresh()
+		select {
+		case <-ticker.C:
+		case <-ui.refreshNow:
+		}
+	}
+}
+
+// selectChannel makes the channel the source, then the destination,
+// and once both are chosen asks about the rebalance.
+func (ui *tui) selectChannel(row int) {
+	if row < 1 || row > len(ui.shown) {
+		return
+	}
+	chanId := ui.shown[row-1].Chan.ChanId
+	switch {
+	case ui.srcChan == 0 || ui.dstChan != 0:
+		ui.srcChan, ui.dstChan = chanId, 0
+	case chanId != ui.srcChan:
+		ui.dstChan = chanId
+	}
+	ui.showChannels()
+	ui.setStatus("selected%s", ui.selection())
+	if ui.srcChan != 0 && ui.dstChan != 0 {
+		ui.openPrompt(gCfg.Recommend.TransferAmount)
+	}
+}
+
+// openPrompt asks for the amount and fee limit of the rebalance of the
+// selected channels.
+func (ui *tui) openPrompt(amount int64) {
+	if ui.rebalancing {
+		ui.setStatus("[yellow]a rebalance is already running")
+		return
+	}
+	limitPPM := int64(0)
+	func() {
+		defer func() {
+			if rr := recover(); rr != nil {
+				ui.setStatus("[red]%v", tview.Escape(fmt.Sprint(rr)))
+			}
+		}()
+		limitPPM = int64(chanFeeLimitRate(amount, ui.dstChan) * 1e6)
+	}()
+
+	ui.prompt.Clear(true)
+	ui.prompt.AddInputField("Amount", strconv.FormatInt(amount, 10), 12,
+		tview.InputFieldInteger, nil)
+	ui.prompt.AddInputField("Fee limit ppm", strconv.FormatInt(limitPPM, 10), 12,
+		tview.InputFieldInteger, nil)
+	ui.prompt.AddButton("Rebalance", func() {
+		amt, err1 := strconv.ParseInt(ui.promptText("Amount"), 10, 64)
+		ppm, err2 := strconv.ParseInt(ui.promptText("Fee limit ppm"), 10, 64)
+		if err1 != nil || err2 != nil || amt <= 0 || ppm < 0 {
+			ui.setStatus("[red]bad amount or fee limit")
+			return
+		}
+		ui.closePrompt()
+		ui.startRebalance(amt, float64(ppm)/1e6)
+	})
+	ui.prompt.AddButton("Cancel", ui.closePrompt)
+	ui.prompt.SetTitle(fmt.Sprintf(" Rebalance %s -> %s ",
+		fmtChanId(ui.srcChan), fmtChanId(ui.dstChan)))
+	ui.pages.ShowPage("prompt")
+	ui.app.SetFocus(ui.prompt)
+}
+
+func (ui *tui) promptText(label string) string {
+	return ui.prompt.GetFormItemByLabel(label).(*tview.InputField).GetText()
+}
+
+func (ui *tui) closePrompt() {
+	ui.pages.HidePage("prompt")
+	ui.app.SetFocus(ui.channels)
+}
+
+// startRebalance runs the rebalance in the background, its output goes
+// to the log pane.
+func (ui *tui) startRebalance(amt int64, limitRate float64) {
+	ui.rebalancing = true
+	src, dst := ui.srcChan, ui.dstChan
+	// Channels selected while it runs are for the next rebalance.
+	ui.srcChan, ui.dstChan = 0, 0
+	ui.showChannels()
+	ui.setStatus("rebalancing %d sat %s -> %s", amt, fmtChanId(src), fmtChanId(dst))
+	go func() {
+		ok := false
+		defer func() {
+			if rr := recover(); rr != nil {
+				fmt.Printf("rebalance failed: %v\n", rr)
+			}
+			ui.app.QueueUpdateDraw(func() {
+				ui.rebalancing = false
+				if ok {
+					ui.setStatus("[green]rebalanced %d sat", amt)
+				} else {
+					ui.setStatus("[red]rebalance failed")
+				}
+			})
+			ui.refreshNow <- true
+		}()
+		fmt.Printf("rebalance %d sat %s -> %s, fee limit %.0f ppm\n",
+			amt, fmtChanId(src), fmtChanId(dst), limitRate*1e6)
+		ok = doRebalance(amt, src, dst, limitRate)
+	}()
+}
+
+// captureOutput sends what the commands print to the writer instead of
+// the terminal, which tview owns, until the returned function is
+// called.
+func captureOutput(writer io.Writer) (func(), error) {
+	rr, ww, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.Stdout
+	os.Stdout = ww
+	color.SetOutput(ww)
+
+	done := make(chan bool)
+	go func() {
+		io.Copy(writer, rr)
+		close(done)
+	}()
+	return func() {
+		os.Stdout = stdout
+		color.ResetOutput()
+		ww.Close()
+		<-done
+	}, nil
+}
+
+func (ui *tui) handleKey(event *tcell.EventKey) *tcell.EventKey {
+	// Leave the keys to the prompt and the filter while they're in use.
+	if front, _ := ui.pages.GetFrontPage(); front != "main" {
+		return event
+	}
+	if ui.app.GetFocus() == ui.filter {
+		return event
+	}
+
+	switch event.Key() {
+	case tcell.KeyTab:
+		focus := []tview.Primitive{ui.channels, ui.recs, ui.history, ui.log}
+		for ndx, item := range focus {
+			if ui.app.GetFocus() == item {
+				ui.app.SetFocus(focus[(ndx+1)%len(focus)])
+				return nil
+			}
+		}
+		ui.app.SetFocus(ui.channels)
+		return nil
+	case tcell.KeyCtrlC:
+		// Quitting would exit with the payment in flight and
+		// its outcome unrecorded.
+		if ui.rebalancing {
+			ui.setStatus("[yellow]wait for the rebalance to finish before quitting")
+			return nil
+		}
+		return event
+	case tcell.KeyEscape:
+		ui.srcChan, ui.dstChan = 0, 0
+		ui.showChannels()
+		ui.setStatus("selection cleared")
+		return nil
+	}
+
+	switch event.Rune() {
+	case 'q':
+		if ui.rebalancing {
+			ui.setStatus("[yellow]wait for the rebalance to finish before quitting")
+			return nil
+		}
+		ui.app.Stop()
+		return nil
+	case 's':
+		ui.sortNdx = (ui.sortNdx + 1) % len(chanSortKeys)
+		ui.showChannels()
+		return nil
+	case 'r':
+		ui.reverse = !ui.reverse
+		ui.showChannels()
+		return nil
+	case '/':
+		ui.app.SetFocus(ui.filter)
+		return nil
+	case 'u':
+		ui.setStatus("updating")
+		go func() { ui.refreshNow <- true }()
+		return nil
+	}
+	return event
+}
+
+func (ui *tui) filterDone(key tcell.Key) {
+	if key == tcell.KeyEscape {
+		ui.filter.SetText("")
+	}
+	ui.matchPeer = nil
+	if text := ui.filter.GetText(); text != "" {
+		matchPeer, err := peerMatcher(text)
+		if err != nil {
+			ui.setStatus("[red]%s", tview.Escape(err.Error()))
+			return
+		}
+		ui.matchPeer = matchPeer
+	}
+	ui.showChannels()
+	ui.app.SetFocus(ui.channels)
+}
+
+// recommendationSelected fills the prompt from the recommended loop.
+func (ui *tui) recommendationSelected(row, _ int) {
+	if ui.data == nil || row < 1 || row > len(ui.data.Recs) {
+		return
+	}
+	rec := ui.data.Recs[row-1]
+	ui.srcChan, ui.dstChan = rec.Loop.SrcChan, rec.Loop.DstChan
+	ui.showChannels()
+	ui.openPrompt(rec.Amount)
+}
+
+func runTui(interval time.Duration) error {
+	ui := &tui{
+		app:        tview.NewApplication(),
+		pages:      tview.NewPages(),
+		channels:   tview.NewTable(),
+		recs:       tview.NewTable(),
+		history:    tview.NewTable(),
+		log:        tview.NewTextView(),
+		status:     tview.NewTextView(),
+		filter:     tview.NewInputField(),
+		prompt:     tview.NewForm(),
+		refreshNow: make(chan bool),
+	}
+
+	ui.channels.SetFixed(1, 0).SetSelectable(true, false).
+		SetSelectedFunc(func(row, _ int) { ui.selectChannel(row) })
+	ui.channels.SetBorder(true)
+	ui.recs.SetFixed(1, 0).SetSelectable(true, false).
+		SetSelectedFunc(ui.recommendationSelected)
+	ui.recs.SetBorder(true).SetTitle(" Recommended ")
+	ui.history.SetFixed(1, 0).SetSelectable(true, false)
+	ui.history.SetBorder(true).SetTitle(" Loop history ")
+	ui.log.SetDynamicColors(true).SetMaxLines(1000).
+		SetChangedFunc(func() { ui.app.Draw() }).
+		ScrollToEnd()
+	ui.log.SetBorder(true).SetTitle(" Rebalance log ")
+	ui.status.SetDynamicColors(true)
+	ui.filter.SetLabel("Filter: ").SetDoneFunc(ui.filterDone)
+	ui.prompt.SetCancelFunc(ui.closePrompt)
+	ui.prompt.SetBorder(true)
+
+	help := tview.NewTextView().SetText(
+		"enter select src/dst  s sort  r reverse  / filter  u update  tab pane  esc clear  q quit")
+
+	left := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(ui.channels, 0, 3, true).
+		AddItem(ui.log, 0, 1, false)
+	right := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(ui.recs, 0, 1, false).
+		AddItem(ui.history, 0, 1, false)
+	body := tview.NewFlex().
+		AddItem(left, 0, 2, true).
+		AddItem(right, 0, 1, false)
+	main := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(body, 0, 1, true).
+		AddItem(ui.filter, 1, 0, false).
+		AddItem(ui.status, 1, 0, false).
+		AddItem(help, 1, 0, false)
+
+	// The prompt floats in the middle of the screen.
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(ui.prompt, 9, 0, true).
+			AddItem(nil, 0, 1, false), 50, 0, true).
+		AddItem(nil, 0, 1, false)
+
+	ui.pages.AddPage("main", main, true, true)
+	ui.pages.AddPage("prompt", modal, true, false)
+	ui.app.SetRoot(ui.pages, true).SetInputCapture(ui.handleKey)
+
+	restore, err := captureOutput(tview.ANSIWriter(ui.log))
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	// Load the channel points now, the goroutines only read them.
+	if gCfg.ChanIdFormat == "chanpoint" {
+		loadChanPoints()
+	}
+
+	ui.setStatus("loading")
+	go ui.refreshLoop(interval)
+	return ui.app.Run()
+}